@@ -17,6 +17,7 @@ do
 done
 
 sudo rm -r /tmp/openfaas-hypervisor-*
+sudo rm -f microvms/*/rootfs.ext4.*
 for i in $(seq 0 9);
 do
        for j in $(seq 0 9);
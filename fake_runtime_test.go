@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"openfaas-hypervisor/pkg"
+	"sync"
+	"time"
+)
+
+// fakeRuntime runs function instances in memory instead of booting VMs or
+// containers. Each instance is an HTTP server on loopback that calls /ready
+// once its boot latency has passed.
+type fakeRuntime struct {
+	// How long an instance takes to call /ready after it is started
+	bootLatency time.Duration
+	// Instances crash while booting and never call /ready
+	crashOnBoot bool
+	// Body every invocation responds with. Instances echo the request body when empty.
+	response string
+	// Serves invocations in place of the echo or response body when set
+	handler http.HandlerFunc
+	// Instances ask for keep-alive connections when calling /ready
+	keepAlive bool
+
+	lock        sync.Mutex
+	instances   map[string]*fakeInstance
+	started     int
+	stopped     int
+	connections int
+}
+
+type fakeInstance struct {
+	server  *httptest.Server
+	stopped chan struct{}
+	// Receives the error the instance's process exits with
+	exit   chan error
+	stderr *pkg.RingBuffer
+	logs   *pkg.LogBuffer
+}
+
+// Exit status of a fake instance's process
+type fakeExitError int
+
+func (e fakeExitError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+func (e fakeExitError) ExitCode() int {
+	return int(e)
+}
+
+func newFakeRuntime() *fakeRuntime {
+	return &fakeRuntime{instances: make(map[string]*fakeInstance)}
+}
+
+// Changes the boot latency of instances started from now on
+func (f *fakeRuntime) setBootLatency(latency time.Duration) {
+	f.lock.Lock()
+	f.bootLatency = latency
+	f.lock.Unlock()
+}
+
+func (f *fakeRuntime) start(functionName string, metadata *InstanceMetadata) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(f.invoke))
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			f.lock.Lock()
+			f.connections++
+			f.lock.Unlock()
+		}
+	}
+	server.Start()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	metadata.ip = host
+	metadata.port = port
+	registerFunctionInstance(metadata)
+
+	instance := &fakeInstance{server: server, stopped: make(chan struct{}), exit: make(chan error, 1), stderr: metadata.stderr, logs: metadata.logs}
+	superviseFunctionInstance(metadata, func() error {
+		select {
+		case err := <-instance.exit:
+			return err
+		case <-instance.stopped:
+			return nil
+		}
+	})
+	f.lock.Lock()
+	f.instances[metadata.instanceId] = instance
+	f.started++
+	latency := f.bootLatency
+	f.lock.Unlock()
+
+	metadata.vmStartTime = time.Now()
+	if f.crashOnBoot {
+		server.Close()
+		return
+	}
+
+	// calls /ready the way a guest does, from the instance's address with its token
+	query := "?token=" + metadata.readinessToken
+	if f.keepAlive {
+		query = "?keepalive=1&token=" + metadata.readinessToken
+	}
+	go func() {
+		select {
+		case <-time.After(latency):
+		case <-instance.stopped:
+			return
+		}
+		req := httptest.NewRequest(http.MethodPost, "/ready"+query, nil)
+		req.RemoteAddr = net.JoinHostPort(host, "40000")
+		registerInstanceReady(httptest.NewRecorder(), req)
+	}()
+}
+
+func (f *fakeRuntime) stop(metadata *InstanceMetadata) {
+	f.lock.Lock()
+	instance := f.instances[metadata.instanceId]
+	delete(f.instances, metadata.instanceId)
+	f.stopped++
+	f.lock.Unlock()
+
+	if instance != nil {
+		close(instance.stopped)
+		instance.server.Close()
+	}
+}
+
+func (f *fakeRuntime) invoke(w http.ResponseWriter, r *http.Request) {
+	if f.handler != nil {
+		f.handler(w, r)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if f.response != "" {
+		body = []byte(f.response)
+	}
+	w.Write(body)
+}
+
+// Crashes up to count running instances, which stop accepting connections
+// without the hypervisor stopping them
+func (f *fakeRuntime) crash(count int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, instance := range f.instances {
+		if count == 0 {
+			return
+		}
+		instance.server.Close()
+		count--
+	}
+}
+
+// Makes up to count running instances exit with code after writing stderr,
+// without the hypervisor stopping them
+func (f *fakeRuntime) exit(count int, code int, stderr string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, instance := range f.instances {
+		if count == 0 {
+			return
+		}
+		instance.server.Close()
+		instance.stderr.Write([]byte(stderr))
+		instance.exit <- fakeExitError(code)
+		count--
+	}
+}
+
+// Writes text to the console of every running instance
+func (f *fakeRuntime) log(text string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, instance := range f.instances {
+		instance.logs.Write([]byte(text))
+	}
+}
+
+// Number of instances started and stopped so far
+func (f *fakeRuntime) counts() (int, int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.started, f.stopped
+}
+
+// Number of connections accepted by all instances so far
+func (f *fakeRuntime) connectionCount() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.connections
+}
+
+// Number of instances that are running
+func (f *fakeRuntime) running() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.instances)
+}
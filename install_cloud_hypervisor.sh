@@ -0,0 +1,6 @@
+#!/bin/bash
+
+release_url="https://github.com/cloud-hypervisor/cloud-hypervisor/releases"
+latest=$(basename $(curl -fsSLI -o /dev/null -w  %{url_effective} ${release_url}/latest))
+curl -L ${release_url}/download/${latest}/cloud-hypervisor-static -o cloud-hypervisor
+chmod +x cloud-hypervisor
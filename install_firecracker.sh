@@ -6,4 +6,5 @@ arch=`uname -m`
 curl -L ${release_url}/download/${latest}/firecracker-${latest}-${arch}.tgz | tar -xz
 
 mv release-${latest}-$(uname -m)/firecracker-${latest}-$(uname -m) firecracker
+mv release-${latest}-$(uname -m)/jailer-${latest}-$(uname -m) jailer
 rm -r release-${latest}-$(uname -m)
\ No newline at end of file
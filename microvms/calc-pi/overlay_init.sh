@@ -0,0 +1,12 @@
+#!/bin/sh
+
+# Runs before init. The rootfs is attached read-only and shared by every
+# instance of the function, so writes go to the instance's scratch drive
+# through an overlay that becomes the new root.
+mount -t ext4 /dev/vdb /overlay
+mkdir -p /overlay/root /overlay/work
+mount -t overlay -o lowerdir=/,upperdir=/overlay/root,workdir=/overlay/work overlay /mnt
+mount --move /dev /mnt/dev
+pivot_root /mnt /mnt/rom
+
+exec /sbin/init
@@ -12,4 +12,4 @@ for d in bin etc lib sbin usr; do tar c "/$d" | tar x -C /my-rootfs; done
 # However, this is just a warning, so you should be able to
 # proceed with the setup process.
 
-for dir in dev proc run sys var; do mkdir /my-rootfs/${dir}; done
\ No newline at end of file
+for dir in dev proc run sys var overlay mnt rom; do mkdir /my-rootfs/${dir}; done
\ No newline at end of file
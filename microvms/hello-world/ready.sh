@@ -1,3 +1,32 @@
 #!/bin/sh
 
-/bin/server $(route -n | grep 'UG[ \t]' | awk '{print $2}')
\ No newline at end of file
+# Backends without a metadata service pass the environment on the kernel
+# command line as ofh.env.NAME=value, globbing is off so values stay as is
+set -f
+for param in $(cat /proc/cmdline); do
+    case "$param" in
+        ofh.env.*) export "${param#ofh.env.}" ;;
+    esac
+done
+set +f
+
+# Instances without a network are reached over vsock
+if grep -q 'ofh.transport=vsock' /proc/cmdline; then
+    exec /bin/server vsock
+fi
+
+# Read the instance configuration from the Firecracker metadata service, falling
+# back to the default gateway when the hypervisor doesn't publish one
+mmds=http://169.254.169.254/openfaas
+ip route add 169.254.169.254 dev eth0 2>/dev/null
+hypervisor=$(wget -q -T 1 -O - $mmds/hypervisorIp)
+if [ -n "$hypervisor" ]; then
+    token=$(wget -q -O - $mmds/readinessToken)
+    for name in $(wget -q -O - $mmds/env/); do
+        export "$name=$(wget -q -O - $mmds/env/$name)"
+    done
+else
+    hypervisor=$(route -n | grep 'UG[ \t]' | awk '{print $2}')
+fi
+
+/bin/server $hypervisor $token
@@ -31,32 +31,100 @@
  * POSSIBILITY OF SUCH DAMAGE.
  */
 
+#define _GNU_SOURCE
 #include <stdio.h>
 #include <string.h>
 #include <sys/socket.h>
 #include <arpa/inet.h>
+#include <linux/vm_sockets.h>
 #include <unistd.h>
 #include <errno.h>
 #include <stdlib.h>
 #include <time.h>
 
 #define HOST_PORT 8080
-#define LISTEN_PORT 8080
-static const char reply[] = "HTTP/1.1 200 OK\r\n" \
+#define DEFAULT_LISTEN_PORT 8080
+static const char reply_template[] = "HTTP/1.1 200 OK\r\n" \
 			    "Content-type: text/html\r\n" \
-			    "Connection: close\r\n" \
+			    "Content-Length: %zu\r\n" \
+			    "Connection: %s\r\n" \
 			    "\r\n" \
-			    "Hello World\n";
+			    "%s";
+static const char body[] = "Hello World\n";
 
-static const char readyMessage[] = "POST /ready HTTP/1.1\r\nHost: 8080\r\n\r\n";
+static const char readyTemplate[] = "POST /ready?keepalive=1%s%s HTTP/1.1\r\nHost: 8080\r\n\r\n";
 
 #define BUFLEN 2048
 static char recvbuf[BUFLEN];
 
-void register_ready(char *ip) {
+static size_t buffered;
+
+/*
+ * Reads the next request on a connection and discards its body. Returns 0
+ * once the connection is closed. keep_alive is cleared when the client asks
+ * to close the connection or sends a chunked body, which isn't parsed.
+ */
+static int read_request(int client, int *keep_alive)
+{
+	char *end, *field;
+	ssize_t n;
+	size_t header_len, body_len = 0, pending;
+
+	while (!(end = memmem(recvbuf, buffered, "\r\n\r\n", 4))) {
+		/* Headers larger than the buffer aren't supported */
+		if (buffered == BUFLEN)
+			return 0;
+		n = read(client, recvbuf + buffered, BUFLEN - buffered);
+		if (n <= 0)
+			return 0;
+		buffered += n;
+	}
+	header_len = end + 4 - recvbuf;
+	*end = '\0';
+
+	field = strcasestr(recvbuf, "\r\ncontent-length:");
+	if (field)
+		body_len = strtoul(field + strlen("\r\ncontent-length:"), NULL, 10);
+	*keep_alive = !strcasestr(recvbuf, "\r\nconnection: close") &&
+		      !strcasestr(recvbuf, "\r\ntransfer-encoding:");
+
+	/* Discard the body, keeping the start of a pipelined request */
+	pending = buffered - header_len;
+	if (pending >= body_len) {
+		buffered = pending - body_len;
+		memmove(recvbuf, recvbuf + header_len + body_len, buffered);
+		return 1;
+	}
+	body_len -= pending;
+	buffered = 0;
+	while (body_len > 0) {
+		n = read(client, recvbuf, body_len < BUFLEN ? body_len : BUFLEN);
+		if (n <= 0)
+			return 0;
+		body_len -= n;
+	}
+	return 1;
+}
+
+void register_ready(char *ip, char *token) {
 	int valread, client_fd;
     struct sockaddr_in serv_addr;
     char buffer[1024] = { 0 };
+    char readyMessage[256];
+
+    // the readiness token is optional, hypervisors without one identify instances by ip
+    snprintf(readyMessage, sizeof(readyMessage), readyTemplate, token ? "&token=" : "", token ? token : "");
+    // guests without a network reach the hypervisor over vsock
+    if (strcmp(ip, "vsock") == 0) {
+        struct sockaddr_vm host_addr = { .svm_family = AF_VSOCK, .svm_cid = VMADDR_CID_HOST, .svm_port = HOST_PORT };
+        if ((client_fd = socket(AF_VSOCK, SOCK_STREAM, 0)) < 0 ||
+            connect(client_fd, (struct sockaddr *)&host_addr, sizeof(host_addr)) < 0) {
+            printf("\nVsock connection failed \n");
+            exit(-1);
+        }
+        goto send_ready;
+    }
+
     if ((client_fd = socket(AF_INET, SOCK_STREAM, 0)) < 0) {
         printf("\n Socket creation error \n");
         exit(-1);
@@ -76,6 +144,7 @@ void register_ready(char *ip) {
         printf("\nConnection Failed \n");
         exit(-1);
     }
+send_ready:
     send(client_fd, readyMessage, strlen(readyMessage), 0);
     printf("Register message sent!\n");
 
@@ -87,22 +156,33 @@ void register_ready(char *ip) {
 
 int main(int argc, char *argv[])
 {
+	// the hypervisor sets PORT when running the server as a local process on loopback
+	int listen_port = getenv("PORT") ? atoi(getenv("PORT")) : DEFAULT_LISTEN_PORT;
 	int rc = 0;
-	int srv, client;
+	int srv, client, keep_alive;
 	ssize_t n;
 	struct sockaddr_in srv_addr;
+	// "vsock" in place of the hypervisor IP serves over vsock instead of the network
+	int vsock = argc > 1 && strcmp(argv[1], "vsock") == 0;
+	struct sockaddr_vm vsock_addr = { .svm_family = AF_VSOCK, .svm_cid = VMADDR_CID_ANY, .svm_port = listen_port };
+
+	// stdout is a pipe to the instance log when run as a local process, flush every line
+	setvbuf(stdout, NULL, _IOLBF, 0);
 
-	srv = socket(AF_INET, SOCK_STREAM, 0);
+	srv = socket(vsock ? AF_VSOCK : AF_INET, SOCK_STREAM, 0);
 	if (srv < 0) {
 		fprintf(stderr, "Failed to create socket: %d\n", errno);
 		goto out;
 	}
 
 	srv_addr.sin_family = AF_INET;
-	srv_addr.sin_addr.s_addr = INADDR_ANY;
-	srv_addr.sin_port = htons(LISTEN_PORT);
+	srv_addr.sin_addr.s_addr = getenv("PORT") ? htonl(INADDR_LOOPBACK) : INADDR_ANY;
+	srv_addr.sin_port = htons(listen_port);
 
-	rc = bind(srv, (struct sockaddr *) &srv_addr, sizeof(srv_addr));
+	if (vsock)
+		rc = bind(srv, (struct sockaddr *) &vsock_addr, sizeof(vsock_addr));
+	else
+		rc = bind(srv, (struct sockaddr *) &srv_addr, sizeof(srv_addr));
 	if (rc < 0) {
 		fprintf(stderr, "Failed to bind socket: %d\n", errno);
 		goto out;
@@ -116,9 +196,9 @@ int main(int argc, char *argv[])
 	}
 
 	// register as ready with hypervisor
-	register_ready(argv[1]);
+	register_ready(argv[1], argc > 2 ? argv[2] : NULL);
 
-	printf("Listening on port %d...\n", LISTEN_PORT);
+	printf("Listening on port %d...\n", listen_port);
 	while (1) {
 		client = accept(srv, NULL, 0);
 		if (client < 0) {
@@ -128,15 +208,22 @@ int main(int argc, char *argv[])
 			goto out;
 		}
 
-		/* Receive some bytes (ignore errors) */
-		read(client, recvbuf, BUFLEN);
-
-		/* Send reply */
-		n = write(client, reply, sizeof(reply) - 1);
-		if (n < 0)
-			fprintf(stderr, "Failed to send a reply\n");
-		else
-			printf("Sent a reply\n");
+		/* Serve requests until the client closes the connection */
+		buffered = 0;
+		do {
+			if (!read_request(client, &keep_alive))
+				break;
+
+			/* Send reply */
+			char reply[sizeof(reply_template) + sizeof(body) + 32];
+			int len = snprintf(reply, sizeof(reply), reply_template, strlen(body),
+					   keep_alive ? "keep-alive" : "close", body);
+			n = write(client, reply, len);
+			if (n < 0)
+				fprintf(stderr, "Failed to send a reply\n");
+			else
+				printf("Sent a reply\n");
+		} while (keep_alive && n >= 0);
 
 		/* Close connection */
 		close(client);
@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/fs"
@@ -11,6 +12,8 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"openfaas-hypervisor/pkg"
 	AtomicIpIterator "openfaas-hypervisor/pkg"
 	AtomicIterator "openfaas-hypervisor/pkg"
@@ -20,15 +23,20 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/firecracker-microvm/firecracker-go-sdk"
 	"github.com/firecracker-microvm/firecracker-go-sdk/client/models"
+	FirecrackerVsock "github.com/firecracker-microvm/firecracker-go-sdk/vsock"
 	"github.com/google/uuid"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	FaasProviderlogs "github.com/openfaas/faas-provider/logs"
 	FaasProvidertypes "github.com/openfaas/faas-provider/types"
 	"golang.org/x/sys/unix"
 )
@@ -38,49 +46,138 @@ const (
 	bridgeMask         = "16"
 	bridgeName         = "ofhbr"
 	tapBaseName        = "ofhtap"
-	kernelImagePath    = "microvms/vmlinux"
-	rootfsPathTemplate = "microvms/%s/rootfs.ext4"
 	networkName        = "funcnet"
 	ifName             = "veth0"
-	kernelPathTemplate = "unikernels/%s/build/httpreply_kvm-x86_64"
 	firecrackerBinPath = "./firecracker"
+	cloudHypervisorBin = "./cloud-hypervisor"
+	jailerBinPath      = "./jailer"
+	jailerChrootBase   = "/srv/jailer"
+	jailerCgroupBase   = "/sys/fs/cgroup/firecracker"
+	vethBaseName       = "ofhveth"
+	hypervisorPort     = "8080"
+	instancePort       = "8080"
+	loopbackIp         = "127.0.0.1"
+	readinessTimeout   = 30
+	cgroupSliceName    = "openfaas-hypervisor.slice"
+	maxBodyBytes       = 64 * 1024 * 1024
+	// MicroVMs boot from their function's rootfs read-only, with writes
+	// going to a scratch drive of their own through an overlay set up by overlayInit
+	scratchDriveBytes = 16 * 1024 * 1024
+	overlayInit       = "/sbin/overlay-init"
+	// Container bundles go on a tmpfs mounted here unless CONTAINER_BUNDLE_DIR
+	// names a directory, as overlayfs can't keep their writable layers on an
+	// overlayfs such as the root of a Docker container
+	containerBundleBase = "/run/openfaas-hypervisor"
+	// Connections to instances
+	instanceDialTimeout     = 5 * time.Second
+	instanceIdleConnTimeout = 90 * time.Second
+	instanceProbeTimeout    = time.Second
+	// How much of an instance's stderr is kept to explain a crash
+	stderrTailBytes = 4 * 1024
+	// Lines of console and VMM output kept in memory per instance, and how
+	// many stopped instances of a function keep theirs
+	instanceLogLines     = 1000
+	retainedInstanceLogs = 8
+	// Longest a /system/logs request follows logs for
+	logsTimeout = time.Hour
+	// Guests reached over vsock listen on vsockPort and call /ready on the
+	// same port of the host. Context IDs below 3 are reserved.
+	vsockPort    = 8080
+	vsockCidBase = 3
 )
 
 // Enum to determine which mode the hypervisor is running in
 type OFHTYPE int64
 
 const (
-	UNIKERNEL = iota
-	MICROVM   = iota
-	CONTAINER = iota
+	UNIKERNEL       = iota
+	MICROVM         = iota
+	CONTAINER       = iota
+	CLOUDHYPERVISOR = iota
+	PROCESS         = iota
 )
 
 var ofhtype OFHTYPE
 
+// Starts and stops instances in place of the backend selected by ofhtype when
+// set. The tests use it to run instances in memory.
+type functionRuntime interface {
+	// Must register the instance before it can call /ready
+	start(functionName string, metadata *InstanceMetadata)
+	stop(metadata *InstanceMetadata)
+}
+
+var instanceRuntime functionRuntime
+
 // Maps from function instance IP to function metadata
 var functionInstanceMetadata map[string]*InstanceMetadata = make(map[string]*InstanceMetadata)
 var functionInstanceMetadataLock sync.Mutex = sync.Mutex{}
 
 // Maps from function name to a pool of ready instances
 var readyFunctionInstances map[string]*pkg.VmPool = make(map[string]*pkg.VmPool)
+
+// Maps from function instance IP to a channel closed once the instance is ready
 var functionReadyConditions sync.Map
 
+// Maps from function name to its manifest
+var functionManifests map[string]*pkg.Manifest = make(map[string]*pkg.Manifest)
+
+// Maps from function name to the environment variables, secrets and annotations it was last deployed with
+var functionDeployments map[string]FaasProvidertypes.FunctionDeployment = make(map[string]FaasProvidertypes.FunctionDeployment)
+var functionDeploymentsLock sync.Mutex = sync.Mutex{}
+
 var ipIterator = AtomicIpIterator.ParseIP(bridgeIp)
 var tapIterator = AtomicIterator.New()
+var vsockCidIterator = AtomicIterator.New()
+
+// Accepts /ready calls from QEMU guests over vsock, started with the first of them
+var vsockReadyListenerOnce sync.Once
 
 var stats = Stats.NewStats()
 
+// Set once the hypervisor starts shutting down
+var shuttingDown atomic.Bool
+
+// Cgroup instances are placed under, nil when per-instance accounting is unavailable
+var cgroupSlice *pkg.Cgroup
+
+// Maps from function name to the summed cgroup counters of its stopped instances
+var stoppedInstanceCgroupStats map[string]pkg.CgroupStats = make(map[string]pkg.CgroupStats)
+var stoppedInstanceCgroupStatsLock sync.Mutex = sync.Mutex{}
+
+// Largest request and response bodies passed through to and from functions, 0 for no limit
+var maxRequestBodyBytes int64 = maxBodyBytes
+var maxResponseBodyBytes int64 = maxBodyBytes
+
+var errResponseTooLarge = errors.New("Function response too large")
+
+// Maps from function name to the crashes of its instances
+var functionCrashes map[string]pkg.CrashStats = make(map[string]pkg.CrashStats)
+var functionCrashesLock sync.Mutex = sync.Mutex{}
+
+// Directory container bundles are created in, and whether main mounted a tmpfs on it
+var containerBundleDir string
+var containerBundleTmpfs bool
+
+// Console and VMM output of every instance, kept in memory only unless main sets a directory
+var instanceLogs = pkg.NewInstanceLogs("", instanceLogLines, retainedInstanceLogs)
+
+// Maps from the ID of a paused instance to the instance once it is idle, nil
+// while an invocation still has it. Paused instances are kept out of their
+// function's pool until they are resumed.
+var pausedInstances map[string]*InstanceMetadata = make(map[string]*InstanceMetadata)
+var pausedInstancesLock sync.Mutex = sync.Mutex{}
+
+// Maps from function instance address to its latest memory usage sample
+var instanceMemory map[string]pkg.InstanceMemory = make(map[string]pkg.InstanceMemory)
+var instanceMemoryLock sync.Mutex = sync.Mutex{}
+
 func main() {
-	// Check for kvm access
-	err := unix.Access("/dev/kvm", unix.W_OK)
-	if err != nil {
-		fmt.Printf("Cannot access /dev/kvm. Try enabling kvm or running as root.\n")
-		log.Fatal(err)
-	}
+	var err error
 
-	// Check for root access
-	if x, y := 0, os.Getuid(); x != y {
-		log.Fatal("Root acccess denied")
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		runBench(os.Args[2:])
+		return
 	}
 
 	// Select weather using unikernels or microvms
@@ -88,11 +185,30 @@ func main() {
 		ofhtype = MICROVM
 	} else if os.Getenv("OFHTYPE") == "CONTAINER" {
 		ofhtype = CONTAINER
+	} else if os.Getenv("OFHTYPE") == "CLOUD_HYPERVISOR" {
+		ofhtype = CLOUDHYPERVISOR
+	} else if os.Getenv("OFHTYPE") == "PROCESS" {
+		ofhtype = PROCESS
 	} else {
 		ofhtype = UNIKERNEL
 	}
 
-	if ofhtype == MICROVM || ofhtype == UNIKERNEL {
+	// local processes need neither kvm nor root
+	if ofhtype != PROCESS {
+		// Check for kvm access
+		err = unix.Access("/dev/kvm", unix.W_OK)
+		if err != nil {
+			fmt.Printf("Cannot access /dev/kvm. Try enabling kvm or running as root.\n")
+			log.Fatal(err)
+		}
+
+		// Check for root access
+		if x, y := 0, os.Getuid(); x != y {
+			log.Fatal("Root acccess denied")
+		}
+	}
+
+	if usesBridge() {
 		// setup network bridge
 		err = Network.AddBridge(bridgeName, bridgeIp, bridgeMask)
 		if err != nil {
@@ -101,6 +217,32 @@ func main() {
 		}
 	}
 
+	// account and limit each instance in its own cgroup where cgroup v2 is available
+	cgroupSlice, err = pkg.NewCgroupSlice(cgroupSliceName)
+	if err != nil {
+		log.Printf("Per-instance cgroup accounting disabled: %s", err)
+	}
+
+	// instance logs are written under INSTANCE_LOG_DIR, by default in the temporary directory
+	instanceLogDir := os.Getenv("INSTANCE_LOG_DIR")
+	if instanceLogDir == "" {
+		instanceLogDir = filepath.Join(os.TempDir(), "openfaas-hypervisor-logs")
+	}
+	instanceLogs = pkg.NewInstanceLogs(instanceLogDir, instanceLogLines, retainedInstanceLogs)
+
+	if ofhtype == CONTAINER {
+		containerBundleDir = os.Getenv("CONTAINER_BUNDLE_DIR")
+		if containerBundleDir == "" {
+			containerBundleDir = containerBundleBase
+			err = pkg.MountTmpfs(containerBundleDir)
+			if err != nil {
+				log.Print(err)
+				shutdown()
+			}
+			containerBundleTmpfs = true
+		}
+	}
+
 	// Shutdown server properly
 	go func() {
 		sigint := make(chan os.Signal, 1)
@@ -111,52 +253,133 @@ func main() {
 
 	// initialise readyFunctionInstances
 	var vms []fs.DirEntry
-	if ofhtype == MICROVM {
-		vms, err = os.ReadDir("./microvms")
-		println("Function instances type: microvm")
+	var functionsDir string
+	var defaultManifest pkg.Manifest
+	if ofhtype == MICROVM || ofhtype == CLOUDHYPERVISOR {
+		// both VMMs boot the same kernel and rootfs images
+		functionsDir = "./microvms"
+		defaultManifest = pkg.Manifest{Runtime: pkg.RuntimeMicroVM, Kernel: "../vmlinux", Rootfs: "rootfs.ext4"}
+		if ofhtype == MICROVM {
+			println("Function instances type: microvm")
+		} else {
+			println("Function instances type: microvm (cloud hypervisor)")
+		}
 	} else if ofhtype == CONTAINER {
-		vms, err = os.ReadDir("./containers")
+		functionsDir = "./containers"
+		defaultManifest = pkg.Manifest{Runtime: pkg.RuntimeContainer, Rootfs: "rootfs", Entrypoint: []string{"/server"}}
+		defaultManifest.OciRuntime.Binary = os.Getenv("OCI_RUNTIME")
+		if defaultManifest.OciRuntime.Binary == "" {
+			defaultManifest.OciRuntime.Binary = "runsc"
+		}
 		println("Function instances type: container")
+	} else if ofhtype == PROCESS {
+		functionsDir = "./processes"
+		defaultManifest = pkg.Manifest{Runtime: pkg.RuntimeProcess}
+		println("Function instances type: process")
 	} else {
-		vms, err = os.ReadDir("./unikernels")
+		functionsDir = "./unikernels"
+		defaultManifest = pkg.Manifest{Runtime: pkg.RuntimeUnikernel, Kernel: "build/httpreply_kvm-x86_64", Vmm: pkg.VmmQemu}
 		println("Function instances type: unikernel")
 	}
+	defaultManifest.Version = pkg.ManifestVersion
+	defaultManifest.Readiness.TimeoutSeconds = readinessTimeout
+	vms, err = os.ReadDir(functionsDir)
 	if err != nil {
 		log.Fatal(err)
 	}
 	for _, vm := range vms {
 		if vm.IsDir() {
 			functionName := vm.Name()
-			readyFunctionInstances[functionName] = pkg.NewPool(
-				func() any {
-					// Create channel to indicate that vm has initialised
-					readyCondition := sync.NewCond(&sync.Mutex{})
-					metadata := provisionFunctionInstance(functionName)
-					// Store channel so that it can be accessed by /ready
-					functionReadyConditions.Store(metadata.ip, readyCondition)
-					// wait for instance to be ready
-					readyCondition.L.Lock()
-					readyCondition.Wait()
-					readyCondition.L.Unlock()
-					return metadata
-				},
-			)
+			manifest, err := pkg.LoadManifest(filepath.Join(functionsDir, functionName), defaultManifest)
+			if err != nil {
+				log.Fatalf("Failed to load function '%s': %s", functionName, err)
+			}
+			functionManifests[functionName] = manifest
+			// reads the function's secrets and checks its backend can pass them on
+			if _, err := instanceEnvironment(functionName); err != nil {
+				log.Fatalf("Failed to load function '%s': %s", functionName, err)
+			}
+			if manifest.Transport == pkg.TransportVsock && (ofhtype == CLOUDHYPERVISOR || os.Getenv("USE_JAILER") == "TRUE") {
+				log.Fatalf("Failed to load function '%s': the vsock transport is not supported with cloud hypervisor or the jailer", functionName)
+			}
+			if ofhtype == MICROVM || ofhtype == CLOUDHYPERVISOR {
+				// formatted once, instances get a copy of it as their scratch drive
+				err = pkg.CreateScratchImage(scratchTemplatePath(functionName), scratchDriveBytes)
+				if err == nil && ofhtype == MICROVM && os.Getenv("USE_JAILER") == "TRUE" {
+					err = shareRootfsWithJailer(manifest.Rootfs)
+				}
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+			if ofhtype == CONTAINER {
+				// catch bad partial specs at startup rather than on first invocation
+				_, err = containerSpec(functionName, nil, "/run/netns/"+functionName)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+			readyFunctionInstances[functionName] = newInstancePool(functionName)
 		}
 	}
 
 	http.HandleFunc("/function/", invokeFunction)
 	http.HandleFunc("/ready", registerInstanceReady)
-	http.HandleFunc("/system/functions", getDeployedFunctions)
+	http.HandleFunc("/system/functions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost || r.Method == http.MethodPut {
+			updateFunction(w, r)
+		} else {
+			getDeployedFunctions(w, r)
+		}
+	})
 	http.HandleFunc("/system/functions/", getFunctionSummary)
+	http.HandleFunc("/system/logs", getFunctionLogs)
 	http.HandleFunc("/stats", getStats)
+	http.HandleFunc("/stats/samples", getStatsSamples)
+	http.HandleFunc("/stats/memory", getMemoryStats)
 	http.HandleFunc("/preBoot/", preBoot)
+	http.HandleFunc("/instance/", controlInstance)
 	http.HandleFunc("/shutdown", func(w http.ResponseWriter, req *http.Request) {
 		go shutdown()
 		return
 	})
 
+	maxRequestBodyBytes = bodyLimitFromEnv("MAX_REQUEST_BODY_BYTES")
+	maxResponseBodyBytes = bodyLimitFromEnv("MAX_RESPONSE_BODY_BYTES")
+
+	// sample memory every second unless MEMORY_SAMPLE_INTERVAL says otherwise, 0 disables sampling
+	memorySampleInterval := time.Second
+	if interval := os.Getenv("MEMORY_SAMPLE_INTERVAL"); interval != "" {
+		memorySampleInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalf("Invalid MEMORY_SAMPLE_INTERVAL: %s", err)
+		}
+	}
+	if memorySampleInterval > 0 {
+		go sampleInstanceMemory(memorySampleInterval)
+	}
+
+	// probe idle instances every 10 seconds unless INSTANCE_PROBE_INTERVAL says otherwise, 0 disables probing
+	instanceProbeInterval := 10 * time.Second
+	if interval := os.Getenv("INSTANCE_PROBE_INTERVAL"); interval != "" {
+		instanceProbeInterval, err = time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalf("Invalid INSTANCE_PROBE_INTERVAL: %s", err)
+		}
+	}
+	if instanceProbeInterval > 0 {
+		go func() {
+			lastRound := time.Now()
+			for range time.Tick(instanceProbeInterval) {
+				round := time.Now()
+				probeIdleInstances(lastRound)
+				lastRound = round
+			}
+		}()
+	}
+
 	fmt.Printf("Server up!!\n")
-	err = http.ListenAndServe(":8080", nil)
+	err = http.ListenAndServe(":"+hypervisorPort, nil)
 
 	if errors.Is(err, http.ErrServerClosed) {
 		fmt.Printf("server closed\n")
@@ -166,255 +389,1515 @@ func main() {
 	}
 }
 
+// Runs the bench subcommand, which benchmarks a function of an already running
+// hypervisor and writes the latencies it measured as JSON or CSV
+func runBench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	config := pkg.BenchConfig{}
+	flags.StringVar(&config.Url, "url", "http://localhost:"+hypervisorPort, "URL of the hypervisor")
+	flags.StringVar(&config.Function, "function", "calc-pi", "function to invoke")
+	flags.IntVar(&config.Concurrency, "concurrency", 1, "number of clients in a closed loop run")
+	flags.Float64Var(&config.Rate, "rate", 0, "mean requests per second of an open loop run with Poisson arrivals, 0 for a closed loop")
+	flags.DurationVar(&config.Duration, "duration", 10*time.Second, "how long to send requests for, 0 for no limit")
+	flags.IntVar(&config.Requests, "requests", 0, "number of requests to send, 0 for no limit")
+	flags.IntVar(&config.PreBoot, "preboot", 0, "number of instances to boot before the run")
+	flags.StringVar(&config.Body, "body", "", "request body")
+	flags.DurationVar(&config.Timeout, "timeout", time.Minute, "timeout of a single request")
+	flags.DurationVar(&config.MemoryInterval, "memory-interval", 0, "how often to record memory usage during the run, 0 to not record it")
+	output := flags.String("output", "-", "file to write the results to, - for stdout")
+	format := flags.String("format", "json", "output format, json or csv")
+	flags.Parse(args)
+
+	if *format != "json" && *format != "csv" {
+		log.Fatalf("Unknown output format %q", *format)
+	}
+
+	result, err := pkg.RunBench(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("%d requests, %d errors, client latency avg %s p50 %s p95 %s p99 %s max %s",
+		len(result.Client.Samples), result.Client.Errors,
+		time.Duration(result.Client.Summary.AvgNano), time.Duration(result.Client.Summary.P50Nano),
+		time.Duration(result.Client.Summary.P95Nano), time.Duration(result.Client.Summary.P99Nano),
+		time.Duration(result.Client.Summary.MaxNano))
+
+	out := os.Stdout
+	if *output != "-" {
+		out, err = os.Create(*output)
+		if err != nil {
+			log.Fatalf("Failed to create %s: %s", *output, err)
+		}
+		defer out.Close()
+	}
+	if *format == "csv" {
+		err = pkg.WriteBenchCsv(out, result)
+	} else {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "\t")
+		err = encoder.Encode(result)
+	}
+	if err != nil {
+		log.Fatalf("Failed to write results: %s", err)
+	}
+}
+
+// Creates the pool of ready instances of a function, booting a new instance
+// whenever the pool is empty
+func newInstancePool(functionName string) *pkg.VmPool {
+	return pkg.NewPool(func() any {
+		return bootFunctionInstance(functionName)
+	})
+}
+
+// Provisions an instance and waits for it to be ready. Returns nil if it
+// doesn't become ready in time, and an InstanceMetadata otherwise.
+func bootFunctionInstance(functionName string) any {
+	metadata, err := provisionFunctionInstance(functionName)
+	if err != nil {
+		log.Print(err)
+		return nil
+	}
+	if !waitForInstanceReady(&metadata) {
+		if metadata.hasExited() {
+			// its supervisor already released it
+			log.Printf("Instance %s of function '%s' exited before becoming ready", metadata.address(), functionName)
+			return nil
+		}
+		log.Printf("Instance %s of function '%s' did not become ready within %ds", metadata.address(), functionName, functionManifests[functionName].Readiness.TimeoutSeconds)
+		stopFunctionInstance(&metadata)
+		return nil
+	}
+	return metadata
+}
+
+// Containers are networked by CNI and processes use loopback, every other
+// runtime attaches its instances to the hypervisor's bridge
+func usesBridge() bool {
+	return ofhtype != CONTAINER && ofhtype != PROCESS
+}
+
 func shutdown() {
-	if ofhtype == CONTAINER {
-		// shutdown containers
-		for _, value := range functionInstanceMetadata {
-			contaienrId := value.containerId
-			out, err := exec.Command(`runsc`, `kill`, contaienrId).Output()
+	shuttingDown.Store(true)
+	stopAllFunctionInstances()
+
+	if cgroupSlice != nil {
+		err := cgroupSlice.Remove()
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	if usesBridge() {
+		err := Network.DeleteBridge(bridgeName)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	if containerBundleTmpfs {
+		err := pkg.Unmount(containerBundleDir)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+
+	os.Exit(0)
+}
+
+// Stops every instance, whether it is ready, in use or still booting
+func stopAllFunctionInstances() {
+	functionInstanceMetadataLock.Lock()
+	instances := make([]*InstanceMetadata, 0, len(functionInstanceMetadata))
+	for _, value := range functionInstanceMetadata {
+		instances = append(instances, value)
+	}
+	functionInstanceMetadataLock.Unlock()
+
+	for _, instance := range instances {
+		stopFunctionInstance(instance)
+	}
+}
+
+// Stops a single function instance and releases its network resources
+func stopFunctionInstance(metadata *InstanceMetadata) {
+	if !unregisterFunctionInstance(metadata) {
+		// already stopped, or its process exited and its supervisor released it
+		return
+	}
+	terminateFunctionInstance(metadata)
+}
+
+// Removes an instance from functionInstanceMetadata and functionReadyConditions.
+// Returns false when it was already removed, so only one caller tears it down.
+func unregisterFunctionInstance(metadata *InstanceMetadata) bool {
+	functionInstanceMetadataLock.Lock()
+	registered := functionInstanceMetadata[metadata.address()]
+	if registered == nil || registered.instanceId != metadata.instanceId {
+		functionInstanceMetadataLock.Unlock()
+		return false
+	}
+	delete(functionInstanceMetadata, metadata.address())
+	functionInstanceMetadataLock.Unlock()
+	functionReadyConditions.Delete(metadata.address())
+	return true
+}
+
+// Stops an unregistered instance's process unless it already exited, then
+// releases its network, storage and cgroup
+func terminateFunctionInstance(metadata *InstanceMetadata) {
+	if metadata.cgroup != nil {
+		defer releaseInstanceCgroup(metadata)
+	}
+	if metadata.transport != nil {
+		metadata.transport.CloseIdleConnections()
+	}
+
+	if instanceRuntime != nil {
+		instanceRuntime.stop(metadata)
+	} else if ofhtype == CONTAINER {
+		contaienrId := metadata.containerId
+		if metadata.process != nil && !metadata.hasExited() {
+			// a container's init only gets signals it has a handler for, and
+			// function servers don't handle SIGTERM
+			out, err := ociRuntimeCommand(metadata.functionName, `kill`, contaienrId, `KILL`).Output()
 			if err != nil {
 				fmt.Printf("Failed delete container %s: %s, %s\n", contaienrId, err.(*exec.ExitError).Stderr, out)
+			} else {
+				// the runtime's run command exits once the container has stopped using its rootfs
+				metadata.waitForExit()
 			}
+		}
 
-			err = Network.UnbridgeContainer(contaienrId)
+		err := Network.UnbridgeContainer(contaienrId)
+		if err != nil {
+			fmt.Printf("Failed unbridge container %s: %s\n", contaienrId, err)
+		}
+
+		if metadata.bundleDir != "" {
+			err = pkg.UnmountOverlay(filepath.Join(metadata.bundleDir, "rootfs"))
 			if err != nil {
-				fmt.Printf("Failed unbridge container %s: %s\n", contaienrId, err)
+				log.Print(err)
+			} else {
+				err = os.RemoveAll(metadata.bundleDir)
+				if err != nil {
+					log.Printf("Failed to remove container bundle %s: %s", metadata.bundleDir, err)
+				}
 			}
 		}
+	} else if ofhtype == PROCESS {
+		if metadata.process != nil && !metadata.hasExited() {
+			metadata.process.Signal(os.Interrupt)
+			metadata.waitForExit()
+		}
 	} else {
-		// shutdown VMs
-		for _, value := range functionInstanceMetadata {
-			value.process.Signal(os.Interrupt)
-			value.process.Wait()
+		if metadata.apiSocket != "" {
+			if metadata.process != nil && !metadata.hasExited() {
+				// ask cloud hypervisor to exit cleanly, falling back to a signal
+				err := pkg.NewCloudHypervisorClient(metadata.apiSocket).ShutdownVmm()
+				if err != nil {
+					log.Print(err)
+					metadata.process.Signal(os.Interrupt)
+				}
+				metadata.waitForExit()
+			}
+			os.RemoveAll(filepath.Dir(metadata.apiSocket))
+		} else if metadata.qmpSocket != "" {
+			if metadata.process != nil && !metadata.hasExited() {
+				// quit through QMP so QEMU exits cleanly, falling back to a signal
+				qmp, err := pkg.DialQmp(metadata.qmpSocket, time.Second)
+				if err == nil {
+					qmp.Execute("quit", nil)
+					qmp.Close()
+				} else {
+					log.Print(err)
+					metadata.process.Signal(os.Interrupt)
+				}
+				metadata.waitForExit()
+			}
+			os.RemoveAll(filepath.Dir(metadata.qmpSocket))
+		} else if metadata.process != nil && !metadata.hasExited() {
+			metadata.process.Signal(os.Interrupt)
+			metadata.waitForExit()
+		}
+
+		if metadata.vsockListener != nil {
+			metadata.vsockListener.Close()
+		}
+		if metadata.vsockPath != "" {
+			os.RemoveAll(filepath.Dir(metadata.vsockPath))
 		}
 
-		// remove tap devices
-		val := tapIterator.Next()
-		for i := 0; i < val; i++ {
-			tapName := tapBaseName + strconv.FormatInt(int64(i), 10)
-			err := Network.DeleteTap(tapName)
+		if metadata.netns != "" {
+			err := Network.DeleteNetns(metadata.netns)
+			if err != nil {
+				log.Print(err)
+			}
+		} else if metadata.tapName != "" {
+			err := Network.DeleteTap(metadata.tapName)
 			if err != nil {
 				log.Print(err)
 			}
 		}
+		// the address is only reused once nothing can reach the instance on it
+		if metadata.ip != "" {
+			ipIterator.Release(metadata.ip)
+		}
 
-		err := Network.DeleteBridge(bridgeName)
-		if err != nil {
-			log.Print(err)
+		if metadata.scratchDrivePath != "" {
+			err := os.Remove(metadata.scratchDrivePath)
+			if err != nil {
+				log.Printf("Failed to remove instance scratch drive %s: %s", metadata.scratchDrivePath, err)
+			}
+		}
+
+		if metadata.chrootDir != "" {
+			err := os.RemoveAll(metadata.chrootDir)
+			if err != nil {
+				log.Printf("Failed to remove jailer chroot %s: %s", metadata.chrootDir, err)
+			}
+			err = os.Remove(filepath.Join(jailerCgroupBase, metadata.instanceId))
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Printf("Failed to remove jailer cgroup: %s", err)
+			}
 		}
 	}
 
-	os.Exit(0)
+	pausedInstancesLock.Lock()
+	delete(pausedInstances, metadata.instanceId)
+	pausedInstancesLock.Unlock()
+
+	if metadata.logs != nil {
+		metadata.logs.Close()
+	}
+}
+
+// Adds the final counters of a stopped instance's cgroup to its function's
+// totals and removes the cgroup
+func releaseInstanceCgroup(metadata *InstanceMetadata) {
+	cgroupStats, err := metadata.cgroup.Stats()
+	if err == nil {
+		// a stopped instance no longer uses memory
+		cgroupStats.MemoryBytes, cgroupStats.MemoryAnonBytes, cgroupStats.MemoryFileBytes = 0, 0, 0
+		stoppedInstanceCgroupStatsLock.Lock()
+		stoppedInstanceCgroupStats[metadata.functionName] = stoppedInstanceCgroupStats[metadata.functionName].Add(cgroupStats)
+		stoppedInstanceCgroupStatsLock.Unlock()
+	}
+	err = metadata.cgroup.Remove()
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+// Supervises an instance whose process was just started, wait must block
+// until the process exits. Runtimes call it as soon as the process is
+// running, so stopping the instance can rely on its supervisor from then on.
+func superviseFunctionInstance(metadata *InstanceMetadata, wait func() error) {
+	metadata.exited = make(chan struct{})
+	go waitForFunctionInstance(metadata, wait)
+}
+
+// Gives up on a registered instance that could not be started, releasing
+// what was set up for it. It counts as exited so nothing waits for it to
+// become ready.
+func failFunctionInstance(metadata *InstanceMetadata, err error) {
+	log.Printf("Failed to start instance of function '%s': %s", metadata.functionName, err)
+	exited := make(chan struct{})
+	close(exited)
+	metadata.exited = exited
+	if unregisterFunctionInstance(metadata) {
+		terminateFunctionInstance(metadata)
+	}
+}
+
+// Waits for an instance's process to exit. An instance that exits without
+// being stopped has crashed: it is unregistered and released, and the crash
+// is recorded against its function. Copies of it left in the pool are skipped
+// by getReadyInstance.
+func waitForFunctionInstance(metadata *InstanceMetadata, wait func() error) {
+	err := wait()
+	close(metadata.exited)
+	// instances are interrupted along with the hypervisor, which stops them
+	// while shutting down
+	if shuttingDown.Load() || !unregisterFunctionInstance(metadata) {
+		return
+	}
+
+	exitCode, status := 0, "exit status 0"
+	if err != nil {
+		exitCode, status = -1, err.Error()
+	}
+	// satisfied by *exec.ExitError, whose code is -1 when a signal killed the process
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+	stderrTail := string(metadata.stderr.Bytes())
+	log.Printf("Instance %s of function '%s' exited unexpectedly (%s), stderr: %q", metadata.address(), metadata.functionName, status, stderrTail)
+
+	functionCrashesLock.Lock()
+	crashes := functionCrashes[metadata.functionName]
+	crashes.Count++
+	crashes.LastExitCode = exitCode
+	crashes.LastStderrTail = stderrTail
+	crashes.LastCrashTime = time.Now()
+	functionCrashes[metadata.functionName] = crashes
+	functionCrashesLock.Unlock()
+
+	terminateFunctionInstance(metadata)
 }
 
 func invokeFunction(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
 
-	functionName := strings.TrimPrefix(req.URL.Path, "/function/")
+	// everything after the function name is forwarded as a sub-path of /invoke,
+	// escaped as the caller sent it so encoded characters such as %2F and %3F
+	// keep their meaning
+	escapedName, subPath, _ := strings.Cut(strings.TrimPrefix(req.URL.EscapedPath(), "/function/"), "/")
+	functionName, err := url.PathUnescape(escapedName)
+	if err != nil {
+		http.Error(w, "Invalid function name", http.StatusBadRequest)
+		return
+	}
+
+	// reject bodies known to be too large before an instance is taken
+	if maxRequestBodyBytes > 0 {
+		if req.ContentLength > maxRequestBodyBytes {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		req.Body = http.MaxBytesReader(w, req.Body, maxRequestBodyBytes)
+	}
+	// the transport closes the body of a request it fails to send, so the
+	// caller's body is closed here instead to keep it for a retry
+	defer req.Body.Close()
+	body := &requestBody{ReadCloser: req.Body}
+	req.Body = body
+
+	// an instance that fails is stopped and the invocation retried once on
+	// another, as long as nothing was sent to the failed one
+	var functionInstance InstanceMetadata
+	var ctx context.Context
+	var res *http.Response
+	var connRequested, connObtained time.Time
+	for attempt := 1; ; attempt++ {
+		var err error
+		functionInstance, err = getReadyInstance(functionName)
+		if err != nil {
+			log.Printf("Error getting VM instance for function '%s': %s", functionName, err)
+			http.Error(w, "Error getting VM instance for function", http.StatusInternalServerError)
+			return
+		}
+
+		// the invocation is cancelled when the caller goes away or it runs
+		// longer than the function's exec timeout
+		var cancel context.CancelFunc
+		if timeout := functionExecTimeout(functionName); timeout > 0 {
+			ctx, cancel = context.WithTimeout(req.Context(), timeout)
+		} else {
+			ctx, cancel = context.WithCancel(req.Context())
+		}
+		defer cancel()
+
+		outReq, err := newInstanceRequest(ctx, req, functionInstance, subPath)
+		if err != nil {
+			log.Printf("Error creating request for function '%s': %s", functionName, err)
+			http.Error(w, "Error invoking function", http.StatusInternalServerError)
+			releaseFunctionInstance(functionInstance)
+			return
+		}
+		// connection setup is timed separately, it is close to free when a
+		// kept-alive connection is reused
+		connRequested, connObtained = time.Time{}, time.Time{}
+		outReq = outReq.WithContext(httptrace.WithClientTrace(outReq.Context(), &httptrace.ClientTrace{
+			GetConn: func(string) { connRequested = time.Now() },
+			GotConn: func(httptrace.GotConnInfo) { connObtained = time.Now() },
+		}))
+		// redirects are relayed to the caller rather than followed
+		res, err = functionInstance.transport.RoundTrip(outReq)
+		if err == nil {
+			break
+		}
+
+		bytesRead, bodyErr := body.state()
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) || errors.As(bodyErr, &maxBytesErr) {
+			log.Printf("Request body for function '%s' exceeds %d bytes", functionName, maxRequestBodyBytes)
+			// the instance may still be waiting for the rest of the body
+			stopFunctionInstance(&functionInstance)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if ctx.Err() != nil {
+			if req.Context().Err() == nil {
+				http.Error(w, "Function timed out", http.StatusGatewayTimeout)
+			}
+			abandonFunctionInstance(functionInstance, req.Context().Err())
+			return
+		}
+		if bodyErr != nil {
+			log.Printf("Error reading request body for function '%s': %s", functionName, bodyErr)
+			// the instance may still be waiting for the rest of the body
+			stopFunctionInstance(&functionInstance)
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+			return
+		}
+
+		log.Printf("Error invoking instance %s of function '%s', stopping it: %s", functionInstance.address(), functionName, err)
+		stopFunctionInstance(&functionInstance)
+		// a body that was partly sent can't be sent again
+		if attempt > 1 || bytesRead > 0 {
+			http.Error(w, "Error invoking function", http.StatusBadGateway)
+			return
+		}
+	}
+	defer res.Body.Close()
+
+	if maxResponseBodyBytes > 0 && res.ContentLength > maxResponseBodyBytes {
+		log.Printf("Response of function '%s' exceeds %d bytes", functionName, maxResponseBodyBytes)
+		http.Error(w, errResponseTooLarge.Error(), http.StatusBadGateway)
+		releaseFunctionInstance(functionInstance)
+		return
+	}
+
+	pkg.CopyHeaders(w.Header(), res.Header)
+	w.WriteHeader(res.StatusCode)
+	err = streamResponse(w, res)
+	if err != nil && ctx.Err() != nil {
+		abandonFunctionInstance(functionInstance, req.Context().Err())
+	} else {
+		releaseFunctionInstance(functionInstance)
+	}
+	if err != nil {
+		log.Printf("Error streaming response of function '%s': %s", functionName, err)
+		// the status was already sent, abort the response so the client
+		// doesn't mistake a truncated body for a complete one
+		panic(http.ErrAbortHandler)
+	}
+
+	elapsed := time.Since(start)
+	stats.AddFuncExecTimeNano(elapsed.Nanoseconds())
+	stats.AddConnSetupTimeNano(connObtained.Sub(connRequested).Nanoseconds())
+	stats.AddInstanceExecTimeNano(time.Since(connObtained).Nanoseconds())
+}
+
+// Body of a caller's request, shared by every attempt to invoke an instance
+// with it. Closing it is left to invokeFunction, and read errors are recorded
+// so a failing caller isn't mistaken for a failing instance.
+type requestBody struct {
+	io.ReadCloser
+	lock sync.Mutex
+	read int64
+	err  error
+}
+
+func (b *requestBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.lock.Lock()
+	b.read += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	b.lock.Unlock()
+	return n, err
+}
+
+func (b *requestBody) Close() error {
+	return nil
+}
+
+// Returns how much of the body was read and the error reading it failed with
+func (b *requestBody) state() (int64, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.read, b.err
+}
+
+// Builds the request forwarded to an instance, with the caller's method,
+// headers, query and body. subPath must be escaped. The body is streamed to the instance as it arrives,
+// chunked when its length is unknown.
+func newInstanceRequest(ctx context.Context, req *http.Request, functionInstance InstanceMetadata, subPath string) (*http.Request, error) {
+	instanceUrl := "http://" + functionInstance.invokeAddress() + "/invoke"
+	if subPath != "" {
+		instanceUrl += "/" + subPath
+	}
+	if req.URL.RawQuery != "" {
+		instanceUrl += "?" + req.URL.RawQuery
+	}
+
+	body := req.Body
+	if req.ContentLength == 0 {
+		body = http.NoBody
+	}
+	outReq, err := http.NewRequestWithContext(ctx, req.Method, instanceUrl, body)
+	if err != nil {
+		return nil, err
+	}
+	outReq.ContentLength = req.ContentLength
+	pkg.CopyHeaders(outReq.Header, req.Header)
+	pkg.SetForwardedHeaders(outReq, req)
+	return outReq, nil
+}
+
+// Returns an instance to its function's pool after an invocation, unless it
+// was paused during the invocation
+func releaseFunctionInstance(functionInstance InstanceMetadata) {
+	if os.Getenv("DISABLE_VM_REUSE") == "TRUE" {
+		return
+	}
+	if holdIfPaused(functionInstance) {
+		return
+	}
+	functionInstance.lastInvoked.Store(time.Now().UnixNano())
+	readyFunctionInstances[functionInstance.functionName].Put(functionInstance)
+}
+
+// Marks an instance as paused, so no invocation is sent to it until it is
+// resumed. The instance may be pooled, booting or in use, so it is held back
+// wherever it is next handed out or released.
+func holdPausedInstance(metadata *InstanceMetadata) {
+	pausedInstancesLock.Lock()
+	if _, paused := pausedInstances[metadata.instanceId]; !paused {
+		pausedInstances[metadata.instanceId] = nil
+	}
+	pausedInstancesLock.Unlock()
+}
+
+// Holds an instance back instead of handing it out or pooling it if it is
+// paused. Returns whether it was held.
+func holdIfPaused(instance InstanceMetadata) bool {
+	pausedInstancesLock.Lock()
+	defer pausedInstancesLock.Unlock()
+	held, paused := pausedInstances[instance.instanceId]
+	if paused && held == nil {
+		pausedInstances[instance.instanceId] = &instance
+	}
+	return paused
+}
+
+// Returns a resumed instance to its function's pool if it was held back
+// while paused
+func releasePausedInstance(metadata *InstanceMetadata) {
+	pausedInstancesLock.Lock()
+	held := pausedInstances[metadata.instanceId]
+	delete(pausedInstances, metadata.instanceId)
+	pausedInstancesLock.Unlock()
+	if held != nil {
+		releaseFunctionInstance(*held)
+	}
+}
+
+// Stops an instance whose invocation timed out or whose caller went away, as it
+// may still be busy with the invocation. The pool boots a replacement when
+// the function is next invoked.
+func abandonFunctionInstance(functionInstance InstanceMetadata, callerErr error) {
+	if callerErr != nil {
+		log.Printf("Caller of function '%s' went away, stopping instance %s", functionInstance.functionName, functionInstance.address())
+	} else {
+		log.Printf("Invocation of function '%s' timed out, stopping instance %s", functionInstance.functionName, functionInstance.address())
+	}
+	stopFunctionInstance(&functionInstance)
+}
+
+// Returns how long an invocation of a function may run, 0 for no limit. The
+// exec timeout annotation of the function's deployment or manifest overrides
+// the manifest's exec timeout.
+func functionExecTimeout(functionName string) time.Duration {
+	manifest := functionManifests[functionName]
+	timeout := time.Duration(manifest.Exec.TimeoutSeconds) * time.Second
+	if value, ok := manifest.Annotations[pkg.ExecTimeoutAnnotation]; ok {
+		timeout = overrideExecTimeout(functionName, timeout, value)
+	}
+
+	functionDeploymentsLock.Lock()
+	deployment := functionDeployments[functionName]
+	functionDeploymentsLock.Unlock()
+	if deployment.Annotations != nil {
+		if value, ok := (*deployment.Annotations)[pkg.ExecTimeoutAnnotation]; ok {
+			timeout = overrideExecTimeout(functionName, timeout, value)
+		}
+	}
+	return timeout
+}
+
+// Parses an exec timeout annotation, keeping timeout when it is invalid
+// rather than lifting the limit
+func overrideExecTimeout(functionName string, timeout time.Duration, value string) time.Duration {
+	override, err := pkg.ParseExecTimeout(value)
+	if err != nil {
+		log.Printf("Ignoring exec timeout annotation of function '%s': %s", functionName, err)
+		return timeout
+	}
+	return override
+}
+
+// Copies a function's response to the client as it arrives. Chunked and
+// event stream responses are flushed after every read so events aren't held
+// back by buffering.
+func streamResponse(w http.ResponseWriter, res *http.Response) error {
+	flusher, canFlush := w.(http.Flusher)
+	flush := canFlush && (res.ContentLength < 0 || strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream"))
+
+	buf := make([]byte, 32*1024)
+	var written int64
+	for {
+		n, err := res.Body.Read(buf)
+		if n > 0 {
+			written += int64(n)
+			if maxResponseBodyBytes > 0 && written > maxResponseBodyBytes {
+				return errResponseTooLarge
+			}
+			if _, writeErr := w.Write(buf[:n]); writeErr != nil {
+				return writeErr
+			}
+			if flush {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Parses a body size limit from an environment variable, keeping the default when unset
+func bodyLimitFromEnv(name string) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return maxBodyBytes
+	}
+	limit, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || limit < 0 {
+		log.Fatalf("Invalid %s: %q", name, value)
+	}
+	return limit
+}
+
+// Get a ready function instance and removes it from the ready list
+func getReadyInstance(functionName string) (InstanceMetadata, error) {
+	instancePool := readyFunctionInstances[functionName]
+	if instancePool == nil {
+		return InstanceMetadata{}, fmt.Errorf("Function %s does not exist.", functionName)
+	}
+	for {
+		readyInstance := instancePool.Get()
+		if readyInstance == nil {
+			return InstanceMetadata{}, fmt.Errorf("Function %s instance failed to become ready.", functionName)
+		}
+		// instances that exited while pooled were already released by their
+		// supervisor, and instances paused while pooled or booting are held back
+		if instance := readyInstance.(InstanceMetadata); !instance.hasExited() && !holdIfPaused(instance) {
+			return instance, nil
+		}
+	}
+}
+
+// Register that a function VM has booted and is ready to be invoked
+func registerInstanceReady(w http.ResponseWriter, r *http.Request) {
+	instanceIP := strings.Split((*r).RemoteAddr, ":")[0]
+	token := r.URL.Query().Get("token")
+	functionInstanceMetadataLock.Lock()
+	metadata := functionInstanceMetadata[instanceIP]
+	if metadata == nil && token != "" {
+		metadata = instanceWithToken(token)
+	}
+	functionInstanceMetadataLock.Unlock()
+	if metadata == nil {
+		log.Printf("Ready received from unknown instance %s", instanceIP)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if token != "" && token != metadata.readinessToken {
+		log.Printf("Ready received from instance %s with an invalid token", instanceIP)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	timeElapsed := time.Now().Sub(metadata.vmStartTime)
+	ready, loaded := functionReadyConditions.LoadAndDelete(metadata.address())
+	if loaded {
+		// nothing uses the transport before the instance is ready
+		if metadata.transport != nil && r.URL.Query().Get("keepalive") == "1" {
+			metadata.transport.DisableKeepAlives = false
+		}
+		close(ready.(chan struct{}))
+	}
+	// do this last to prevent locks from slowing down function execution
+	stats.AddVmInitTimeNano(timeElapsed.Nanoseconds())
+}
+
+// Finds the instance a readiness token was issued to. Local processes all
+// connect from the loopback address, so they can't be told apart by IP.
+// Must be called with functionInstanceMetadataLock held.
+func instanceWithToken(token string) *InstanceMetadata {
+	for _, metadata := range functionInstanceMetadata {
+		if metadata.readinessToken == token {
+			return metadata
+		}
+	}
+	return nil
+}
+
+// Waits for an instance to call /ready, giving up after the readiness timeout
+// in its function's manifest or when its process exits
+func waitForInstanceReady(metadata *InstanceMetadata) bool {
+	var timeout <-chan time.Time
+	if timeoutSeconds := functionManifests[metadata.functionName].Readiness.TimeoutSeconds; timeoutSeconds != 0 {
+		timeout = time.After(time.Duration(timeoutSeconds) * time.Second)
+	}
+
+	select {
+	case <-metadata.ready:
+		return true
+	case <-metadata.exited:
+		return false
+	case <-timeout:
+		return false
+	}
+}
+
+// Makes an instance visible to /ready. Must be called before the instance is started.
+func registerFunctionInstance(metadata *InstanceMetadata) {
+	functionInstanceMetadataLock.Lock()
+	functionInstanceMetadata[metadata.address()] = metadata
+	functionInstanceMetadataLock.Unlock()
+	functionReadyConditions.Store(metadata.address(), metadata.ready)
+}
+
+// Records the process of an instance once it is started. The instance is
+// already registered by then, so the process is set under
+// functionInstanceMetadataLock for the memory sampler.
+func setInstanceProcess(metadata *InstanceMetadata, process *os.Process) {
+	functionInstanceMetadataLock.Lock()
+	metadata.process = process
+	functionInstanceMetadataLock.Unlock()
+}
+
+func runMicroVM(functionName string, metadata *InstanceMetadata, env map[string]string) {
+	manifest := functionManifests[functionName]
+	createScratchDrive(metadata)
+
+	cfg := firecracker.Config{
+		KernelImagePath: manifest.Kernel,
+		KernelArgs:      strings.TrimSpace(manifest.KernelArgs + " init=" + overlayInit),
+		// the root drive is attached first, as /dev/vda, and the scratch drive as /dev/vdb
+		Drives: firecracker.NewDrivesBuilder(manifest.Rootfs).
+			WithRootDrive(manifest.Rootfs, firecracker.WithReadOnly(true)).
+			AddDrive(metadata.scratchDrivePath, false).
+			Build(),
+		MachineCfg: models.MachineConfiguration{
+			VcpuCount:  firecracker.Int64(1),
+			MemSizeMib: firecracker.Int64(50),
+		},
+	}
+
+	if metadata.vsockCid != 0 {
+		// without a network there is no metadata service, the guest finds the
+		// transport and its environment on the kernel command line
+		registerFunctionInstance(metadata)
+		cfg.KernelArgs = strings.TrimSpace(cfg.KernelArgs + " ofh.transport=vsock " + pkg.GuestKernelCmdlineEnv(env))
+		startFirecrackerMachine(metadata, newFirecrackerMachine(metadata, cfg))
+		return
+	}
+
+	networkInterface := configureFirecrackerNetworking(metadata)
+	registerFunctionInstance(metadata)
+
+	_, ipnet, _ := net.ParseCIDR(metadata.ip + "/" + bridgeMask)
+	networkInterface.StaticConfiguration.IPConfiguration = &firecracker.IPConfiguration{
+		IPAddr:  net.IPNet{IP: net.ParseIP(metadata.ip), Mask: ipnet.Mask},
+		Gateway: net.ParseIP(bridgeIp),
+		IfName:  "eth0",
+	}
+	networkInterface.AllowMMDS = true
+	cfg.NetworkInterfaces = []firecracker.NetworkInterface{networkInterface}
+	// MMDS v1 can be queried with plain GET requests, which busybox wget supports
+	cfg.MmdsAddress = net.ParseIP(pkg.MmdsAddress)
+	cfg.MmdsVersion = firecracker.MMDSv1
+
+	// Environment variables are published through MMDS rather than the kernel
+	// command line so values aren't restricted and secrets stay out of /proc/cmdline
+	mmdsDocument := pkg.MmdsDocument{OpenFaaS: pkg.MmdsInstanceConfig{
+		FunctionName:   functionName,
+		InstanceId:     metadata.instanceId,
+		HypervisorIp:   bridgeIp,
+		CallbackUrl:    "http://" + bridgeIp + ":" + hypervisorPort + "/ready",
+		ReadinessToken: metadata.readinessToken,
+		Env:            env,
+	}}
+
+	m := newFirecrackerMachine(metadata, cfg)
+	m.Handlers.FcInit = m.Handlers.FcInit.Append(firecracker.NewSetMetadataHandler(mmdsDocument))
+	startFirecrackerMachine(metadata, m)
+}
+
+// Path of the scratch drive formatted when a microVM function is loaded
+func scratchTemplatePath(functionName string) string {
+	return functionManifests[functionName].Rootfs + ".scratch"
+}
+
+// Gives a microVM its own copy of its function's scratch drive. The function's
+// rootfs is shared read-only, so concurrent instances can't corrupt each
+// other's filesystem, and only the small scratch drive is copied on boot.
+func createScratchDrive(metadata *InstanceMetadata) {
+	metadata.scratchDrivePath = functionManifests[metadata.functionName].Rootfs + "." + metadata.instanceId
+	err := pkg.CloneFile(scratchTemplatePath(metadata.functionName), metadata.scratchDrivePath)
+	if err == nil && os.Getenv("USE_JAILER") == "TRUE" {
+		// the jailer hard links drives into the chroot without changing their
+		// owner, and the jailed Firecracker must be able to write to this one
+		err = os.Chown(metadata.scratchDrivePath, jailerId("JAILER_UID"), jailerId("JAILER_GID"))
+	}
+	if err != nil {
+		log.Print(err)
+		shutdown()
+	}
+}
 
-	functionInstance, err := getReadyInstance(functionName)
+// Lets the jailed Firecracker read a function's shared rootfs, which is hard
+// linked into every chroot as is
+func shareRootfsWithJailer(rootfs string) error {
+	info, err := os.Stat(rootfs)
+	if err == nil {
+		err = os.Chown(rootfs, -1, jailerId("JAILER_GID"))
+	}
+	if err == nil {
+		err = os.Chmod(rootfs, info.Mode().Perm()|0040)
+	}
 	if err != nil {
-		log.Printf("Error getting VM instance for function '%s': %s", functionName, err)
-		http.Error(w, "Error getting VM instance for function", http.StatusInternalServerError)
+		return fmt.Errorf("Failed to share rootfs %s with the jailer: %s", rootfs, err)
+	}
+	return nil
+}
+
+// Runs a Unikraft image built for the fc platform. It is networked like a
+// microVM, but configures its interface from the netdev kernel arguments.
+func runFirecrackerUnikernel(functionName string, metadata *InstanceMetadata, env map[string]string) {
+	var networkInterfaces []firecracker.NetworkInterface
+	if metadata.vsockCid == 0 {
+		networkInterfaces = append(networkInterfaces, configureFirecrackerNetworking(metadata))
+	}
+	registerFunctionInstance(metadata)
+
+	cfg := firecracker.Config{
+		KernelImagePath: functionManifests[functionName].Kernel,
+		KernelArgs:      unikernelKernelArgs(functionName, metadata, env),
+		MachineCfg: models.MachineConfiguration{
+			VcpuCount:  firecracker.Int64(1),
+			MemSizeMib: firecracker.Int64(10),
+		},
+		NetworkInterfaces: networkInterfaces,
+	}
+
+	m := newFirecrackerMachine(metadata, cfg)
+	// The SDK parses kernel arguments into a map, which would reorder them
+	// and break the application arguments after "--"
+	m.Handlers.FcInit = m.Handlers.FcInit.Remove(firecracker.SetupKernelArgsHandlerName)
+	startFirecrackerMachine(metadata, m)
+}
+
+// Sets up the tap device of a Firecracker instance, inside its own network
+// namespace when it runs under the jailer
+func configureFirecrackerNetworking(metadata *InstanceMetadata) firecracker.NetworkInterface {
+	var tapName, macAddr string
+	if os.Getenv("USE_JAILER") == "TRUE" {
+		tapName, macAddr = configureJailedVmNetworking(metadata)
+	} else {
+		tapName, macAddr = configureVmNetworking(metadata)
+	}
+	return firecracker.NetworkInterface{
+		StaticConfiguration: &firecracker.StaticNetworkConfiguration{
+			MacAddress:  macAddr,
+			HostDevName: tapName,
+		},
+	}
+}
+
+func newFirecrackerMachine(metadata *InstanceMetadata, cfg firecracker.Config) *firecracker.Machine {
+	ctx := context.Background()
+	var opts []firecracker.Opt
+	if os.Getenv("USE_JAILER") == "TRUE" {
+		// the socket path is inside the chroot, which the jailer chowns to the jailed user
+		cfg.SocketPath = "/firecracker.socket"
+		cfg.JailerCfg = jailerConfig(metadata)
+		cfg.JailerCfg.Stdout = metadata.logs
+		cfg.JailerCfg.Stderr = io.MultiWriter(metadata.stderr, metadata.logs)
+		cfg.NetNS = filepath.Join("/var/run/netns", metadata.netns)
+		metadata.chrootDir = filepath.Join(cfg.JailerCfg.ChrootBaseDir, filepath.Base(cfg.JailerCfg.ExecFile), cfg.JailerCfg.ID)
+	} else {
+		// Setup socket path
+		tempdir, err := ioutil.TempDir("", "openfaas-hypervisor-")
+		if err != nil {
+			log.Printf("Error creating firecracker socket: %s", err)
+			shutdown()
+		}
+		cfg.SocketPath = filepath.Join(tempdir, "socket")
+		if metadata.vsockCid != 0 {
+			configureFirecrackerVsock(metadata, &cfg, tempdir)
+		}
+
+		cmd := firecracker.VMCommandBuilder{}.WithSocketPath(cfg.SocketPath).WithBin(firecrackerBinPath).WithStdout(metadata.logs).WithStderr(io.MultiWriter(metadata.stderr, metadata.logs)).Build(ctx)
+		cmd.SysProcAttr = instanceSysProcAttr(metadata)
+		opts = append(opts, firecracker.WithProcessRunner(cmd))
+	}
+
+	m, err := firecracker.NewMachine(ctx, cfg, opts...)
+	if err != nil {
+		log.Printf("failed to create new machine: %v", err)
+		shutdown()
+	}
+	return m
+}
+
+// Adds a vsock device to a Firecracker instance. Firecracker proxies the
+// guest's connections to port P of the host to the unix socket <path>_P, and
+// connections to the guest through a handshake on the socket itself.
+func configureFirecrackerVsock(metadata *InstanceMetadata, cfg *firecracker.Config, dir string) {
+	metadata.vsockPath = filepath.Join(dir, "vsock")
+	cfg.VsockDevices = []firecracker.VsockDevice{{ID: "vsock0", Path: metadata.vsockPath, CID: metadata.vsockCid}}
+
+	listener, err := net.Listen("unix", metadata.vsockPath+"_"+strconv.Itoa(vsockPort))
+	if err != nil {
+		log.Printf("Error listening for vsock connections: %s", err)
+		shutdown()
+	}
+	metadata.vsockListener = listener
+	// the socket belongs to this instance alone, so it stands in for the
+	// guest's address
+	go serveVsockReady(listener, pkg.VsockAddr{Cid: metadata.vsockCid}.String())
+
+	vsockPath := metadata.vsockPath
+	metadata.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return FirecrackerVsock.DialContext(ctx, vsockPath, vsockPort)
+	}
+}
+
+// Serves /ready to guests connecting over vsock. Connections from a QEMU guest
+// carry its context ID as the remote address, Firecracker's unix socket
+// connections get remoteAddr instead.
+func serveVsockReady(listener net.Listener, remoteAddr string) {
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ready" {
+			http.NotFound(w, r)
+			return
+		}
+		if remoteAddr != "" {
+			r.RemoteAddr = remoteAddr
+		}
+		registerInstanceReady(w, r)
+	})}
+	err := server.Serve(listener)
+	if err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Error serving vsock readiness: %s", err)
+	}
+}
+
+func startFirecrackerMachine(metadata *InstanceMetadata, m *firecracker.Machine) {
+	metadata.vmStartTime = time.Now()
+	if err := m.Start(context.Background()); err != nil {
+		log.Printf("failed to initialize machine: %v", err)
+		shutdown()
+	}
+
+	pid, err := m.PID()
+	if err != nil {
+		log.Printf("failed to obtain machines PID: %v", err)
+		shutdown()
+	}
+	setInstanceProcess(metadata, &os.Process{Pid: pid})
+	// the SDK reaps the VMM itself
+	superviseFunctionInstance(metadata, func() error {
+		return m.Wait(context.Background())
+	})
+
+	// the jailer starts firecracker in a cgroup of its own
+	if metadata.chrootDir != "" && metadata.cgroup != nil {
+		err = metadata.cgroup.AddProcesses([]int{pid})
+		if err != nil {
+			log.Print(err)
+			shutdown()
+		}
+	} else {
+		addToInstanceCgroup(metadata, pid)
+	}
+}
+
+func runCloudHypervisor(functionName string, metadata *InstanceMetadata, env map[string]string) {
+	tapName, macAddr := configureVmNetworking(metadata)
+	registerFunctionInstance(metadata)
+
+	tempdir, err := ioutil.TempDir("", "openfaas-hypervisor-")
+	if err != nil {
+		log.Printf("Error creating cloud hypervisor socket: %s", err)
+		shutdown()
+	}
+	metadata.apiSocket = filepath.Join(tempdir, "api.sock")
+
+	manifest := functionManifests[functionName]
+	createScratchDrive(metadata)
+
+	// There is no metadata service, so the network and environment are
+	// configured through the kernel command line
+	mask, _ := strconv.Atoi(bridgeMask)
+	netmask := net.IP(net.CIDRMask(mask, 32)).String()
+	cmdline := "console=ttyS0 reboot=k panic=1 root=/dev/vda ro init=" + overlayInit + " ip=" + metadata.ip + "::" + bridgeIp + ":" + netmask + "::eth0:off"
+	cmdline = strings.TrimSpace(cmdline + " " + manifest.KernelArgs + " " + pkg.GuestKernelCmdlineEnv(env))
+
+	cmd := exec.Command(cloudHypervisorBin, `--api-socket`, `path=`+metadata.apiSocket)
+	cmd.SysProcAttr = instanceSysProcAttr(metadata)
+	// the serial console is written to cloud hypervisor's stdout
+	cmd.Stdout = metadata.logs
+	cmd.Stderr = io.MultiWriter(metadata.stderr, metadata.logs)
+	metadata.vmStartTime = time.Now()
+	err = cmd.Start()
+	if err != nil {
+		log.Printf("Error starting cloud hypervisor: %s", err)
+		shutdown()
+	}
+	setInstanceProcess(metadata, cmd.Process)
+	addToInstanceCgroup(metadata, cmd.Process.Pid)
+	superviseFunctionInstance(metadata, cmd.Wait)
+
+	client := pkg.NewCloudHypervisorClient(metadata.apiSocket)
+	err = client.WaitForSocket(5 * time.Second)
+	if err != nil {
+		log.Print(err)
+		shutdown()
+	}
+	err = client.CreateVm(pkg.CloudHypervisorVmConfig{
+		Cpus:    pkg.CloudHypervisorCpus{BootVcpus: 1, MaxVcpus: 1},
+		Memory:  pkg.CloudHypervisorMemory{Size: 50 * 1024 * 1024},
+		Payload: pkg.CloudHypervisorPayload{Kernel: manifest.Kernel, Cmdline: cmdline},
+		Disks:   []pkg.CloudHypervisorDisk{{Path: manifest.Rootfs, Readonly: true}, {Path: metadata.scratchDrivePath}},
+		Net:     []pkg.CloudHypervisorNet{{Tap: tapName, Mac: macAddr}},
+		Serial:  pkg.CloudHypervisorConsole{Mode: "Tty"},
+		Console: pkg.CloudHypervisorConsole{Mode: "Off"},
+	})
+	if err != nil {
+		log.Print(err)
+		shutdown()
+	}
+	err = client.BootVm()
+	if err != nil {
+		log.Print(err)
+		shutdown()
+	}
+}
+
+func runUnikernel(functionName string, metadata *InstanceMetadata, env map[string]string) {
+	manifest := functionManifests[functionName]
+	if manifest.Vmm == pkg.VmmFirecracker {
+		runFirecrackerUnikernel(functionName, metadata, env)
 		return
 	}
 
-	res, err := http.Post("http://"+functionInstance.ip+":8080/invoke", "plain/text", req.Body)
+	var tapName, macAddr string
+	if metadata.vsockCid == 0 {
+		tapName, macAddr = configureVmNetworking(metadata)
+	} else {
+		vsockReadyListenerOnce.Do(func() {
+			listener, err := pkg.ListenVsock(vsockPort)
+			if err != nil {
+				log.Print(err)
+				shutdown()
+			}
+			go serveVsockReady(listener, "")
+		})
+		cid := metadata.vsockCid
+		metadata.transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return pkg.DialVsock(ctx, cid, vsockPort)
+		}
+	}
+	// each instance gets a QMP socket used to control it once it is running,
+	// known before the instance is registered so /instance/ can find it
+	tempdir, err := ioutil.TempDir("", "openfaas-hypervisor-")
+	if err != nil {
+		log.Printf("Error creating qmp socket: %s", err)
+		shutdown()
+	}
+	metadata.qmpSocket = filepath.Join(tempdir, "qmp.sock")
+	registerFunctionInstance(metadata)
+	kernelArgs := unikernelKernelArgs(functionName, metadata, env)
+
+	var qemuArgs []string
+	netDevice := `virtio-net-pci`
+	vsockDevice := `vhost-vsock-pci`
+	if os.Getenv("QEMU_MICROVM") == "TRUE" {
+		// the microvm machine has no PCI bus or firmware to initialise, devices are attached over virtio-mmio
+		qemuArgs = append(qemuArgs, `-M`, `microvm,x-option-roms=off,pit=off,pic=off,isa-serial=on,rtc=off`, `-nodefaults`, `-no-user-config`, `-serial`, `stdio`)
+		netDevice = `virtio-net-device`
+		vsockDevice = `vhost-vsock-device`
+	}
+	if metadata.vsockCid == 0 {
+		qemuArgs = append(qemuArgs, `-netdev`, `tap,id=en0,ifname=`+tapName+`,script=no,downscript=no`, `-device`, netDevice+`,netdev=en0,mac=`+macAddr)
+	} else {
+		qemuArgs = append(qemuArgs, `-device`, vsockDevice+`,guest-cid=`+strconv.FormatUint(uint64(metadata.vsockCid), 10))
+	}
+	qemuArgs = append(qemuArgs, `-kernel`, manifest.Kernel, `-append`, kernelArgs, `-cpu`, `host`, `-smp`, `1`, `-enable-kvm`, `-nographic`, `-m`, `10M`, `-qmp`, `unix:`+metadata.qmpSocket+`,server=on,wait=off`)
+	qemuCmd := exec.Command(`qemu-system-x86_64`, qemuArgs...)
+	qemuCmd.SysProcAttr = instanceSysProcAttr(metadata)
+	// -nographic puts the serial console on stdout
+	qemuCmd.Stdout = metadata.logs
+	qemuCmd.Stderr = io.MultiWriter(metadata.stderr, metadata.logs)
+	metadata.vmStartTime = time.Now()
+
+	err = qemuCmd.Start()
+	if err != nil {
+		log.Printf("Error starting qemu: %s", err)
+		shutdown()
+	}
+	setInstanceProcess(metadata, qemuCmd.Process)
+	addToInstanceCgroup(metadata, qemuCmd.Process.Pid)
+	superviseFunctionInstance(metadata, qemuCmd.Wait)
+}
+
+// Builds the Unikraft command line of an instance. The network is configured
+// by the netdev library and the application gets the hypervisor IP after "--",
+// or "vsock" when it is reached over vsock and has no network.
+func unikernelKernelArgs(functionName string, metadata *InstanceMetadata, env map[string]string) string {
+	manifest := functionManifests[functionName]
+	kernelArgs := ""
+	appArgs := bridgeIp
+	if metadata.vsockCid == 0 {
+		kernelArgs = `netdev.ipv4_addr=` + metadata.ip + ` netdev.ipv4_gw_addr=` + bridgeIp + ` netdev.ipv4_subnet_mask=255.255.255.0`
+	} else {
+		appArgs = "vsock"
+	}
+	if manifest.KernelArgs != "" {
+		kernelArgs = strings.TrimSpace(kernelArgs + " " + manifest.KernelArgs)
+	}
+	if len(env) > 0 {
+		kernelArgs += " env.vars=[ " + pkg.KernelCmdlineEnv(env) + " ]"
+	}
+	if kernelArgs != "" {
+		kernelArgs += " "
+	}
+	return kernelArgs + `-- ` + appArgs
+}
+
+// Runs the function's server as a child process listening on its own loopback
+// port. It is started with the same arguments ready.sh passes inside a microVM.
+func runProcess(functionName string, metadata *InstanceMetadata, env map[string]string) {
+	port, err := Network.FreeLoopbackPort()
+	if err != nil {
+		log.Print(err)
+		shutdown()
+	}
+	metadata.ip = loopbackIp
+	metadata.port = port
+	registerFunctionInstance(metadata)
+
+	manifest := functionManifests[functionName]
+	args := append(append([]string{}, manifest.Entrypoint[1:]...), loopbackIp, metadata.readinessToken)
+	cmd := exec.Command(manifest.Entrypoint[0], args...)
+	cmd.SysProcAttr = instanceSysProcAttr(metadata)
+	// the hypervisor's own environment isn't inherited so functions only see what they were deployed with
+	cmd.Env = append(append([]string{"PATH=" + os.Getenv("PATH")}, pkg.EnvList(env)...), "PORT="+port)
+	cmd.Stdout = metadata.logs
+	cmd.Stderr = io.MultiWriter(metadata.stderr, metadata.logs)
+	metadata.vmStartTime = time.Now()
+
+	err = cmd.Start()
+	if err != nil {
+		log.Printf("Error starting function process: %s", err)
+		shutdown()
+	}
+	setInstanceProcess(metadata, cmd.Process)
+	addToInstanceCgroup(metadata, cmd.Process.Pid)
+	superviseFunctionInstance(metadata, cmd.Wait)
+}
+
+func runContainer(functionName string, metadata *InstanceMetadata, env map[string]string) {
+	metadata.containerId = metadata.instanceId
+
+	// set up networking
+	ip, err := Network.BridgeContainer(metadata.containerId)
 	if err != nil {
-		fmt.Printf("Error invoking function: %s\n", err)
-		http.Error(w, "Error invoking function", http.StatusInternalServerError)
+		log.Print(err)
 		shutdown()
 	}
-	body, err := ioutil.ReadAll(res.Body)
+	metadata.ip = ip
+	registerFunctionInstance(metadata)
+
+	// create container directory
+	tempdir, err := ioutil.TempDir(containerBundleDir, "openfaas-hypervisor-")
 	if err != nil {
-		log.Printf("Error reading function response: %v", err)
-		http.Error(w, "Error reading function response", http.StatusInternalServerError)
+		failFunctionInstance(metadata, fmt.Errorf("Error creating container bundle directory: %s", err))
 		return
 	}
-	w.Write(body)
 
-	if os.Getenv("DISABLE_VM_REUSE") != "TRUE" {
-		readyFunctionInstances[functionInstance.functionName].Put(functionInstance)
+	// layer a writable upper dir over the function's rootfs instead of copying it
+	err = pkg.MountOverlay(functionManifests[functionName].Rootfs, filepath.Join(tempdir, "upper"), filepath.Join(tempdir, "work"), filepath.Join(tempdir, "rootfs"))
+	if err != nil {
+		os.RemoveAll(tempdir)
+		failFunctionInstance(metadata, err)
+		return
 	}
+	metadata.bundleDir = tempdir
 
-	elapsed := time.Since(start)
-	stats.AddFuncExecTimeNano(elapsed.Nanoseconds())
+	spec, err := containerSpec(functionName, pkg.EnvList(env), "/run/netns/"+metadata.containerId)
+	if err == nil {
+		if metadata.cgroup != nil {
+			// the OCI runtime places the container's processes in the instance's cgroup
+			spec.Linux.CgroupsPath = metadata.cgroup.Path()
+		}
+		err = pkg.WriteOciSpec(spec, tempdir)
+	}
+	if err != nil {
+		failFunctionInstance(metadata, err)
+		return
+	}
+
+	// run container
+	runtimeCmd := ociRuntimeCommand(functionName, `run`, `--bundle`, tempdir, metadata.containerId)
+	// the runtime passes the container's output through
+	runtimeCmd.Stdout = metadata.logs
+	runtimeCmd.Stderr = io.MultiWriter(metadata.stderr, metadata.logs)
+	metadata.vmStartTime = time.Now()
+
+	err = runtimeCmd.Start()
+	if err != nil {
+		failFunctionInstance(metadata, fmt.Errorf("Error starting %s: %s", runtimeCmd.Path, err))
+		return
+	}
+	setInstanceProcess(metadata, runtimeCmd.Process)
+	superviseFunctionInstance(metadata, runtimeCmd.Wait)
 }
 
-// Get a ready function instance and removes it from the ready list
-func getReadyInstance(functionName string) (InstanceMetadata, error) {
-	var readyInstance any = nil
-	for readyInstance == nil {
-		instancePool := readyFunctionInstances[functionName]
-		if instancePool == nil {
-			return InstanceMetadata{}, fmt.Errorf("Function %s does not exist.", functionName)
-		}
-		readyInstance = instancePool.Get()
+// Returns the directory secrets are read from
+func secretsDir() string {
+	if dir := os.Getenv("SECRETS_DIR"); dir != "" {
+		return dir
 	}
-	return readyInstance.(InstanceMetadata), nil
+	return pkg.DefaultSecretsDir
 }
 
-// Register that a function VM has booted and is ready to be invoked
-func registerInstanceReady(w http.ResponseWriter, r *http.Request) {
-	instanceIP := strings.Split((*r).RemoteAddr, ":")[0]
-	functionInstanceMetadataLock.Lock()
-	metadata := functionInstanceMetadata[instanceIP]
-	functionInstanceMetadataLock.Unlock()
-	timeElapsed := time.Now().Sub(metadata.vmStartTime)
-	condition, loaded := functionReadyConditions.LoadAndDelete(instanceIP)
-	if loaded {
-		condition.(*sync.Cond).L.Lock()
-		condition.(*sync.Cond).Signal()
-		condition.(*sync.Cond).L.Unlock()
-	}
-	// do this last to prevent locks from slowing down function execution
-	stats.AddVmInitTimeNano(timeElapsed.Nanoseconds())
+// Builds the environment of a new function instance from its manifest, its
+// deployment and its secrets. The result contains secret values so must never be logged.
+func instanceEnvironment(functionName string) (map[string]string, error) {
+	functionDeploymentsLock.Lock()
+	deployment := functionDeployments[functionName]
+	functionDeploymentsLock.Unlock()
+	return deploymentEnvironment(functionName, deployment)
 }
 
-func runMicroVM(functionName string, metadata *InstanceMetadata) {
-	tapName, macAddr := configureVmNetworking(metadata)
-	functionInstanceMetadataLock.Lock()
-	functionInstanceMetadata[metadata.ip] = metadata
-	functionInstanceMetadataLock.Unlock()
+// Builds the environment instances of a function get once it is deployed with
+// deployment, and checks that its backend can pass the environment on. Values
+// on the kernel command line can't contain whitespace or quotes, and QEMU's
+// command line can be read by any user of the host so it can't carry secrets.
+func deploymentEnvironment(functionName string, deployment FaasProvidertypes.FunctionDeployment) (map[string]string, error) {
+	manifest := functionManifests[functionName]
+	secrets := append(append([]string{}, manifest.Secrets...), deployment.Secrets...)
+
+	env := make(map[string]string)
+	for name, value := range manifest.Env {
+		env[name] = value
+	}
+	for name, value := range deployment.EnvVars {
+		env[name] = value
+	}
+	for _, secret := range secrets {
+		value, err := pkg.ReadSecret(secretsDir(), secret)
+		if err != nil {
+			return nil, err
+		}
+		env[pkg.SecretEnvName(secret)] = value
+	}
 
-	ctx := context.Background()
-	// Setup socket path
-	tempdir, err := ioutil.TempDir("", "openfaas-hypervisor-")
-	if err != nil {
-		log.Printf("Error creating firecracker socket: %s", err)
-		shutdown()
+	if instanceRuntime == nil && envOnKernelCmdline(functionName) {
+		if len(secrets) > 0 && ofhtype == UNIKERNEL && manifest.Vmm == pkg.VmmQemu {
+			return nil, fmt.Errorf("Secrets are not supported by unikernels run under qemu, as any user of the host can read their environment from qemu's command line")
+		}
+		err := pkg.CheckKernelCmdlineEnv(env)
+		if err != nil {
+			return nil, err
+		}
 	}
-	socketPath := filepath.Join(tempdir, "socket")
+	return env, nil
+}
 
-	cmd := firecracker.VMCommandBuilder{}.WithSocketPath(socketPath).WithBin(firecrackerBinPath).Build(ctx)
+// Whether the instances of a function get their environment on the kernel
+// command line, because their backend has no metadata service
+func envOnKernelCmdline(functionName string) bool {
+	return ofhtype == UNIKERNEL || ofhtype == CLOUDHYPERVISOR || (ofhtype == MICROVM && functionManifests[functionName].Transport == pkg.TransportVsock)
+}
 
-	_, ipnet, _ := net.ParseCIDR(metadata.ip + "/" + bridgeMask)
-	networkInterfaces := []firecracker.NetworkInterface{{
-		StaticConfiguration: &firecracker.StaticNetworkConfiguration{
-			MacAddress:  macAddr,
-			HostDevName: tapName,
-			IPConfiguration: &firecracker.IPConfiguration{
-				IPAddr:  net.IPNet{IP: net.ParseIP(metadata.ip), Mask: ipnet.Mask},
-				Gateway: net.ParseIP(bridgeIp),
-				IfName:  "eth0",
-			},
-		},
-	}}
+// Builds a command invoking the OCI runtime configured for a container function
+func ociRuntimeCommand(functionName string, args ...string) *exec.Cmd {
+	ociRuntime := functionManifests[functionName].OciRuntime
+	return exec.Command(ociRuntime.Binary, append(append([]string{}, ociRuntime.Args...), args...)...)
+}
 
-	rootfsPath := fmt.Sprintf(rootfsPathTemplate, functionName)
-	cfg := firecracker.Config{
-		SocketPath:      socketPath,
-		KernelImagePath: kernelImagePath,
-		Drives:          firecracker.NewDrivesBuilder(rootfsPath).Build(),
-		MachineCfg: models.MachineConfiguration{
-			VcpuCount:  firecracker.Int64(1),
-			MemSizeMib: firecracker.Int64(50),
-		},
-		NetworkInterfaces: networkInterfaces,
+// Generates the OCI runtime spec for an instance of a container function,
+// merging in the partial spec from its manifest, and validates the result
+func containerSpec(functionName string, env []string, netnsPath string) (*specs.Spec, error) {
+	manifest := functionManifests[functionName]
+	spec := pkg.GenerateOciSpec(functionName, manifest, env, netnsPath)
+	if manifest.OciSpec != "" {
+		var err error
+		spec, err = pkg.MergeOciSpec(spec, manifest.OciSpec)
+		if err != nil {
+			return nil, err
+		}
 	}
-
-	m, err := firecracker.NewMachine(ctx, cfg, firecracker.WithProcessRunner(cmd))
+	err := pkg.ValidateOciSpec(spec)
 	if err != nil {
-		log.Printf("failed to create new machine: %v", err)
-		shutdown()
+		return nil, fmt.Errorf("Invalid OCI spec for function '%s': %s", functionName, err)
 	}
+	return spec, nil
+}
 
-	metadata.vmStartTime = time.Now()
-	if err := m.Start(ctx); err != nil {
-		log.Printf("failed to initialize machine: %v", err)
-		shutdown()
+// Starts a new instance of a function. Fails without starting it when the
+// function's environment can't be passed to the instance, e.g. when a secret
+// changed since the function was deployed.
+func provisionFunctionInstance(functionName string) (InstanceMetadata, error) {
+	env, err := instanceEnvironment(functionName)
+	if err != nil {
+		return InstanceMetadata{}, fmt.Errorf("Failed to configure instance of function '%s': %s", functionName, err)
 	}
 
-	pid, err := m.PID()
+	metadata := InstanceMetadata{
+		functionName:   functionName,
+		instanceId:     uuid.New().String(),
+		readinessToken: pkg.RandomToken(),
+		ready:          make(chan struct{}),
+		stderr:         pkg.NewRingBuffer(stderrTailBytes),
+		transport:      newInstanceTransport(),
+		lastInvoked:    new(atomic.Int64),
+	}
+	if functionManifests[functionName].Transport == pkg.TransportVsock {
+		metadata.vsockCid = vsockCidBase + uint32(vsockCidIterator.Next())
+	}
+	logs, err := instanceLogs.Open(functionName, metadata.instanceId)
 	if err != nil {
-		log.Printf("failed to obtain machines PID: %v", err)
+		log.Print(err)
 		shutdown()
 	}
-	metadata.process = &os.Process{Pid: pid}
-}
+	metadata.logs = logs
+	if cgroupSlice != nil && instanceRuntime == nil {
+		cgroup, err := cgroupSlice.NewChild(metadata.instanceId, functionManifests[functionName].Resources)
+		if err != nil {
+			log.Print(err)
+			shutdown()
+		}
+		metadata.cgroup = cgroup
+	}
 
-func runUnikernel(functionName string, metadata *InstanceMetadata) {
-	tapName, macAddr := configureVmNetworking(metadata)
-	functionInstanceMetadataLock.Lock()
-	functionInstanceMetadata[metadata.ip] = metadata
-	functionInstanceMetadataLock.Unlock()
+	if instanceRuntime != nil {
+		instanceRuntime.start(functionName, &metadata)
+	} else if ofhtype == MICROVM {
+		runMicroVM(functionName, &metadata, env)
+	} else if ofhtype == CLOUDHYPERVISOR {
+		runCloudHypervisor(functionName, &metadata, env)
+	} else if ofhtype == CONTAINER {
+		runContainer(functionName, &metadata, env)
+	} else if ofhtype == PROCESS {
+		runProcess(functionName, &metadata, env)
+	} else {
+		runUnikernel(functionName, &metadata, env)
+	}
 
-	kernelPath := fmt.Sprintf(kernelPathTemplate, functionName)
-	qemuCmd := exec.Command(`qemu-system-x86_64`, `-netdev`, `tap,id=en0,ifname=`+tapName+`,script=no,downscript=no`, `-device`, `virtio-net-pci,netdev=en0,mac=`+macAddr, `-kernel`, kernelPath, `-append`, `netdev.ipv4_addr=`+metadata.ip+` netdev.ipv4_gw_addr=`+bridgeIp+` netdev.ipv4_subnet_mask=255.255.255.0 -- `+bridgeIp, `-cpu`, `host`, `-smp`, `1`, `-enable-kvm`, `-nographic`, `-m`, `10M`)
-	metadata.vmStartTime = time.Now()
+	return metadata, nil
+}
 
-	err := qemuCmd.Start()
-	if err != nil {
-		log.Printf("Error starting qemu: %s", err)
-		shutdown()
+// Creates the transport for a single instance. Instances are handed out to one
+// invocation at a time, so one connection is enough. Keep-alive stays disabled
+// until the guest negotiates it, as older guests close every connection.
+func newInstanceTransport() *http.Transport {
+	return &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: instanceDialTimeout}).DialContext,
+		DisableKeepAlives:   true,
+		DisableCompression:  true,
+		MaxConnsPerHost:     1,
+		MaxIdleConnsPerHost: 1,
+		IdleConnTimeout:     instanceIdleConnTimeout,
 	}
-	metadata.process = qemuCmd.Process
 }
 
-func runContainer(functionName string, metadata *InstanceMetadata) {
-	metadata.containerId = uuid.New().String()
+// Makes a command start inside the instance's cgroup when it has one
+func instanceSysProcAttr(metadata *InstanceMetadata) *syscall.SysProcAttr {
+	if metadata.cgroup == nil {
+		return nil
+	}
+	return metadata.cgroup.SysProcAttr()
+}
 
-	// set up networking
-	ip, err := Network.BridgeContainer(metadata.containerId)
+// Moves an instance's process into its cgroup once started, when the kernel
+// couldn't start it there
+func addToInstanceCgroup(metadata *InstanceMetadata, pid int) {
+	if metadata.cgroup == nil || metadata.cgroup.StartsProcesses() {
+		return
+	}
+	err := metadata.cgroup.AddProcesses([]int{pid})
 	if err != nil {
 		log.Print(err)
 		shutdown()
 	}
-	metadata.ip = ip
-	functionInstanceMetadataLock.Lock()
-	functionInstanceMetadata[metadata.ip] = metadata
-	functionInstanceMetadataLock.Unlock()
+}
 
-	// create container directory
-	tempdir, err := ioutil.TempDir("", "openfaas-hypervisor-")
+// Builds the jailer configuration for a microVM. The jailed user, group and
+// chroot base directory can be set with JAILER_UID, JAILER_GID and JAILER_CHROOT_BASE.
+func jailerConfig(metadata *InstanceMetadata) *firecracker.JailerConfig {
+	execFile, err := filepath.Abs(firecrackerBinPath)
 	if err != nil {
-		log.Printf("Error creating firecracker socket: %s", err)
+		log.Printf("Error resolving firecracker binary path: %s", err)
 		shutdown()
 	}
-	out, err := exec.Command(`cp`, `-r`, `./containers/`+functionName+`/rootfs`, filepath.Join(tempdir, "rootfs")).Output()
-	if err != nil {
-		log.Printf("Error copying rootfs: %s, %s\n", err.(*exec.ExitError).Stderr, out)
-		shutdown()
+	chrootBase := os.Getenv("JAILER_CHROOT_BASE")
+	if chrootBase == "" {
+		chrootBase = jailerChrootBase
 	}
-	containerConfigTemplate, err := os.ReadFile(`./containers/` + functionName + `/config-template.json`)
-	if err != nil {
-		log.Printf("Error reading container config template: %s", err)
-		shutdown()
+
+	return &firecracker.JailerConfig{
+		UID:            firecracker.Int(jailerId("JAILER_UID")),
+		GID:            firecracker.Int(jailerId("JAILER_GID")),
+		ID:             metadata.instanceId,
+		NumaNode:       firecracker.Int(0),
+		ExecFile:       execFile,
+		JailerBinary:   jailerBinPath,
+		ChrootBaseDir:  chrootBase,
+		CgroupVersion:  "2",
+		ChrootStrategy: firecracker.NewNaiveChrootStrategy(functionManifests[metadata.functionName].Kernel),
+	}
+}
+
+// Reads a uid or gid for the jailer from the environment, defaulting to root
+func jailerId(name string) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return 0
 	}
-	re := regexp.MustCompile(`<netns>`)
-	err = os.WriteFile(filepath.Join(tempdir, "config.json"), re.ReplaceAll(containerConfigTemplate, []byte(metadata.containerId)), 0644)
+	id, err := strconv.Atoi(value)
 	if err != nil {
-		log.Printf("Error writing container config file: %s", err)
+		log.Printf("Invalid %s: %s", name, err)
 		shutdown()
 	}
+	return id
+}
 
-	// run container
-	runscCmd := exec.Command(`runsc`, `run`, `--bundle`, tempdir, metadata.containerId)
-	metadata.vmStartTime = time.Now()
+// Creates a network namespace for a jailed microVM, with a tap device bridged
+// back to the hypervisor's bridge
+func configureJailedVmNetworking(metadata *InstanceMetadata) (string, string) {
+	index := strconv.FormatInt(int64(tapIterator.Next()), 10)
+	metadata.netns = "ofh-" + metadata.instanceId
+	metadata.tapName = tapBaseName + index
 
-	err = runscCmd.Start()
+	err := Network.AddNetnsTap(metadata.netns, vethBaseName+index, metadata.tapName, bridgeName, jailerId("JAILER_UID"), jailerId("JAILER_GID"))
 	if err != nil {
-		log.Printf("Error starting runsc: %s", err)
+		log.Print(err)
 		shutdown()
 	}
-	metadata.process = runscCmd.Process
-}
 
-func provisionFunctionInstance(functionName string) InstanceMetadata {
-	metadata := InstanceMetadata{functionName: functionName}
-	if ofhtype == MICROVM {
-		runMicroVM(functionName, &metadata)
-	} else if ofhtype == CONTAINER {
-		runContainer(functionName, &metadata)
-	} else {
-		runUnikernel(functionName, &metadata)
-	}
+	metadata.ip = ipIterator.Next()
+	macAddr := Network.RandomMacAddress()
 
-	return metadata
+	return metadata.tapName, macAddr
 }
 
 func configureVmNetworking(metadata *InstanceMetadata) (string, string) {
 	tapName := tapBaseName + strconv.FormatInt(int64(tapIterator.Next()), 10)
+	metadata.tapName = tapName
 
 	err := Network.AddTap(tapName, bridgeName)
 	if err != nil {
@@ -435,11 +1918,93 @@ type InstanceMetadata struct {
 	vmStartTime  time.Time
 	process      *os.Process
 	containerId  string
+	tapName      string
+	ready        chan struct{}
+	// Unique ID of the instance and the token it may present when calling /ready
+	instanceId     string
+	readinessToken string
+	// Set for microVMs launched through the jailer
+	netns     string
+	chrootDir string
+	// Writable drive a microVM layers over its function's read-only rootfs
+	scratchDrivePath string
+	// OCI bundle of a container, holding its overlay rootfs
+	bundleDir string
+	// API socket of a cloud hypervisor instance
+	apiSocket string
+	// QMP socket of a qemu instance
+	qmpSocket string
+	// Port the instance listens on when it isn't the default, e.g. for local processes
+	port string
+	// Cgroup the instance is accounted and limited in, nil when accounting is disabled
+	cgroup *pkg.Cgroup
+	// Transport invocations are sent over. Keep-alive is enabled when the
+	// guest asks for it while calling /ready.
+	transport *http.Transport
+	// Context ID of an instance reached over vsock rather than the network, 0 otherwise
+	vsockCid uint32
+	// Host side socket of a Firecracker vsock device and the listener for
+	// /ready calls Firecracker forwards from the guest
+	vsockPath     string
+	vsockListener net.Listener
+	// Closed by the instance's supervisor once its process has exited, nil
+	// until the process is started
+	exited chan struct{}
+	// When the instance last finished an invocation, in Unix nanoseconds.
+	// Shared by every copy of the instance.
+	lastInvoked *atomic.Int64
+	// Latest output of the instance's process on stderr
+	stderr *pkg.RingBuffer
+	// Console output of the guest and the logs of its VMM or runtime
+	logs *pkg.LogBuffer
+}
+
+// Waits for the instance's process to exit, returning at once when it has no
+// supervisor because its process was never started
+func (metadata *InstanceMetadata) waitForExit() {
+	if metadata.exited != nil {
+		<-metadata.exited
+	}
+}
+
+// Whether the instance's process has exited, whether or not it was stopped
+func (metadata *InstanceMetadata) hasExited() bool {
+	select {
+	case <-metadata.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// Key of the instance in functionInstanceMetadata and functionReadyConditions.
+// Instances sharing an IP are told apart by their port.
+func (metadata *InstanceMetadata) address() string {
+	if metadata.vsockCid != 0 {
+		return pkg.VsockHost(metadata.vsockCid)
+	}
+	if metadata.port == "" {
+		return metadata.ip
+	}
+	return net.JoinHostPort(metadata.ip, metadata.port)
+}
+
+// Address the instance's function server is invoked on
+func (metadata *InstanceMetadata) invokeAddress() string {
+	// the host name is only informational, the transport dials the vsock
+	if metadata.vsockCid != 0 {
+		return metadata.address()
+	}
+	if metadata.port == "" {
+		return net.JoinHostPort(metadata.ip, instancePort)
+	}
+	return net.JoinHostPort(metadata.ip, metadata.port)
 }
 
 func getDeployedFunctions(w http.ResponseWriter, r *http.Request) {
 	functions := []FaasProvidertypes.FunctionStatus{}
 	for functionName := range readyFunctionInstances {
+		manifest := functionManifests[functionName]
 		// TODO: get true values
 		functions = append(functions, FaasProvidertypes.FunctionStatus{
 			Name:              functionName,
@@ -447,10 +2012,10 @@ func getDeployedFunctions(w http.ResponseWriter, r *http.Request) {
 			Image:             "None",
 			AvailableReplicas: 1,
 			InvocationCount:   0,
-			Labels:            &(map[string]string{}),
-			Annotations:       &(map[string]string{}),
+			Labels:            &manifest.Labels,
+			Annotations:       &manifest.Annotations,
 			Namespace:         "openfaas",
-			Secrets:           []string{},
+			Secrets:           functionSecrets(functionName),
 			CreatedAt:         time.Now(),
 		})
 	}
@@ -470,16 +2035,22 @@ func getDeployedFunctions(w http.ResponseWriter, r *http.Request) {
 
 func getFunctionSummary(w http.ResponseWriter, r *http.Request) {
 	functionName := strings.TrimPrefix(r.URL.Path, "/system/functions/")
+	manifest := functionManifests[functionName]
+	if manifest == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Function not found"))
+		return
+	}
 	function := FaasProvidertypes.FunctionStatus{
 		Name:              functionName,
 		Replicas:          1,
 		Image:             "None",
 		AvailableReplicas: 1,
 		InvocationCount:   0,
-		Labels:            &(map[string]string{}),
-		Annotations:       &(map[string]string{}),
+		Labels:            &manifest.Labels,
+		Annotations:       &manifest.Annotations,
 		Namespace:         "openfaas",
-		Secrets:           []string{},
+		Secrets:           functionSecrets(functionName),
 		CreatedAt:         time.Now(),
 	}
 
@@ -496,8 +2067,98 @@ func getFunctionSummary(w http.ResponseWriter, r *http.Request) {
 	w.Write(functionBytes)
 }
 
+// Updates the environment variables, secrets and annotations of a function.
+// Instances booted after the update use the new configuration, a new exec
+// timeout applies from the next invocation.
+func updateFunction(w http.ResponseWriter, r *http.Request) {
+	var deployment FaasProvidertypes.FunctionDeployment
+	err := json.NewDecoder(r.Body).Decode(&deployment)
+	if err != nil {
+		log.Printf("Failed to parse function deployment: %s", err.Error())
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Failed to parse function deployment"))
+		return
+	}
+
+	if functionManifests[deployment.Service] == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Function not found"))
+		return
+	}
+	for name := range deployment.EnvVars {
+		if !pkg.ValidEnvName(name) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Invalid environment variable name %q", name)))
+			return
+		}
+	}
+	for _, secret := range deployment.Secrets {
+		if _, err := pkg.ReadSecret(secretsDir(), secret); err != nil {
+			log.Print(err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("Secret %q is not available", secret)))
+			return
+		}
+	}
+	// the error names the offending variable but never contains its value
+	if _, err := deploymentEnvironment(deployment.Service, deployment); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if deployment.Annotations != nil {
+		if value, ok := (*deployment.Annotations)[pkg.ExecTimeoutAnnotation]; ok {
+			if _, err := pkg.ParseExecTimeout(value); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+	}
+
+	functionDeploymentsLock.Lock()
+	functionDeployments[deployment.Service] = FaasProvidertypes.FunctionDeployment{
+		Service:     deployment.Service,
+		EnvVars:     deployment.EnvVars,
+		Secrets:     deployment.Secrets,
+		Annotations: deployment.Annotations,
+	}
+	functionDeploymentsLock.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Streams the console and VMM output of a function's instances as
+// newline-delimited JSON, with the name, instance, tail, since and follow
+// parameters of the faas-provider logs API
+func getFunctionLogs(w http.ResponseWriter, r *http.Request) {
+	if functionManifests[r.URL.Query().Get("name")] == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Function not found"))
+		return
+	}
+	FaasProviderlogs.NewLogHandlerFunc(instanceLogs, logsTimeout)(w, r)
+}
+
+// Returns the names of the secrets made available to a function
+func functionSecrets(functionName string) []string {
+	functionDeploymentsLock.Lock()
+	deployment := functionDeployments[functionName]
+	functionDeploymentsLock.Unlock()
+	return append(append([]string{}, functionManifests[functionName].Secrets...), deployment.Secrets...)
+}
+
+// Response of /stats, the memory usage is added to the summary's fields
+type statsResponse struct {
+	Stats.StatsSummary
+	Memory  pkg.MemoryStats
+	Cgroups pkg.CgroupStatsReport
+	// Maps from function name to the crashes of its instances
+	Crashes map[string]pkg.CrashStats
+}
+
 func getStats(w http.ResponseWriter, r *http.Request) {
-	bytes, err := json.Marshal(stats.GetStatsSummary())
+	bytes, err := json.Marshal(statsResponse{StatsSummary: stats.GetStatsSummary(), Memory: currentMemoryStats(), Cgroups: currentCgroupStats(), Crashes: currentCrashStats()})
 	if err != nil {
 		log.Printf("Failed to stats: %s", err.Error())
 		w.WriteHeader(http.StatusInternalServerError)
@@ -510,8 +2171,219 @@ func getStats(w http.ResponseWriter, r *http.Request) {
 	w.Write(bytes)
 }
 
+// Returns every recorded sample so clients can compute their own distributions
+func getStatsSamples(w http.ResponseWriter, r *http.Request) {
+	bytes, err := json.Marshal(stats.GetSamples())
+	if err != nil {
+		log.Printf("Failed to marshal stats samples: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Failed to marshal stats samples"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
+func getMemoryStats(w http.ResponseWriter, r *http.Request) {
+	bytes, err := json.Marshal(currentMemoryStats())
+	if err != nil {
+		log.Printf("Failed to marshal memory stats: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Failed to marshal memory stats"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bytes)
+}
+
+// Aggregates the latest memory usage sample of every instance
+func currentMemoryStats() pkg.MemoryStats {
+	instanceMemoryLock.Lock()
+	instances := make([]pkg.InstanceMemory, 0, len(instanceMemory))
+	for _, instance := range instanceMemory {
+		instances = append(instances, instance)
+	}
+	instanceMemoryLock.Unlock()
+
+	sort.Slice(instances, func(i, j int) bool {
+		return instances[i].Address < instances[j].Address
+	})
+	return pkg.NewMemoryStats(runtimeName(), instances)
+}
+
+// Reads the cgroup counters of every running instance and adds them to the
+// totals of the instances that have stopped
+func currentCgroupStats() pkg.CgroupStatsReport {
+	report := pkg.CgroupStatsReport{Functions: make(map[string]pkg.FunctionCgroupStats), Instances: []pkg.InstanceCgroupStats{}}
+	var instances []pkg.InstanceCgroupStats
+	var cgroups []*pkg.Cgroup
+	functionInstanceMetadataLock.Lock()
+	for address, metadata := range functionInstanceMetadata {
+		if metadata.cgroup != nil {
+			instances = append(instances, pkg.InstanceCgroupStats{Address: address, Function: metadata.functionName, InstanceId: metadata.instanceId})
+			cgroups = append(cgroups, metadata.cgroup)
+		}
+	}
+	functionInstanceMetadataLock.Unlock()
+
+	stoppedInstanceCgroupStatsLock.Lock()
+	for functionName, cgroupStats := range stoppedInstanceCgroupStats {
+		report.Functions[functionName] = pkg.FunctionCgroupStats{CgroupStats: cgroupStats}
+	}
+	stoppedInstanceCgroupStatsLock.Unlock()
+
+	for i, instance := range instances {
+		cgroupStats, err := cgroups[i].Stats()
+		if err != nil {
+			// the instance may have stopped since it was listed
+			continue
+		}
+		instance.CgroupStats = cgroupStats
+		report.Instances = append(report.Instances, instance)
+
+		function := report.Functions[instance.Function]
+		function.RunningInstances++
+		function.CgroupStats = function.CgroupStats.Add(cgroupStats)
+		report.Functions[instance.Function] = function
+	}
+	sort.Slice(report.Instances, func(i, j int) bool {
+		return report.Instances[i].Address < report.Instances[j].Address
+	})
+	return report
+}
+
+// Copies the crash counts of every function with crashed instances
+func currentCrashStats() map[string]pkg.CrashStats {
+	functionCrashesLock.Lock()
+	defer functionCrashesLock.Unlock()
+	crashes := make(map[string]pkg.CrashStats, len(functionCrashes))
+	for functionName, functionCrash := range functionCrashes {
+		crashes[functionName] = functionCrash
+	}
+	return crashes
+}
+
+// Checks that every idle instance still accepts connections, so instances
+// that crashed while pooled are stopped rather than handed to a caller.
+// Each instance is taken out of its pool only while it is probed, so the
+// rest of the pool keeps serving invocations. Instances that served an
+// invocation after since are known to work and keep their kept-alive
+// connection, which probing them would close.
+func probeIdleInstances(since time.Time) {
+	for _, pool := range readyFunctionInstances {
+		probed := make(map[string]bool)
+		for item := pool.TryGet(); item != nil; item = pool.TryGet() {
+			instance := item.(InstanceMetadata)
+			if probed[instance.instanceId] {
+				// back at an instance probed in this round
+				pool.Put(instance)
+				break
+			}
+			// exited instances were already released by their supervisor, a
+			// paused instance can't answer its probe
+			if instance.hasExited() || holdIfPaused(instance) {
+				continue
+			}
+			probed[instance.instanceId] = true
+			if instance.lastInvoked.Load() > since.UnixNano() {
+				pool.Put(instance)
+				continue
+			}
+			err := probeInstance(&instance)
+			if err != nil {
+				log.Printf("Idle instance %s of function '%s' failed its probe, stopping it: %s", instance.address(), instance.functionName, err)
+				stopFunctionInstance(&instance)
+				continue
+			}
+			pool.Put(instance)
+		}
+	}
+}
+
+// Opens and closes a connection to an instance's function server. Guests
+// serve one connection at a time, so a kept-alive connection is closed first.
+// The CNI plugins also check the network of a container, which can break
+// while its server keeps running.
+func probeInstance(metadata *InstanceMetadata) error {
+	if instanceRuntime == nil && ofhtype == CONTAINER {
+		err := Network.CheckContainer(metadata.containerId)
+		if err != nil {
+			return err
+		}
+	}
+	metadata.transport.CloseIdleConnections()
+	ctx, cancel := context.WithTimeout(context.Background(), instanceProbeTimeout)
+	defer cancel()
+	conn, err := metadata.transport.DialContext(ctx, "tcp", metadata.invokeAddress())
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Samples the memory usage of the process tree of every running instance.
+// Instances that stopped since the last sample are dropped.
+func sampleInstanceMemory(interval time.Duration) {
+	for range time.Tick(interval) {
+		functionInstanceMetadataLock.Lock()
+		instances := make(map[int]pkg.InstanceMemory)
+		for address, metadata := range functionInstanceMetadata {
+			if metadata.process != nil {
+				instances[metadata.process.Pid] = pkg.InstanceMemory{Address: address, Function: metadata.functionName, InstanceId: metadata.instanceId}
+			}
+		}
+		functionInstanceMetadataLock.Unlock()
+
+		children, err := pkg.ProcessChildren()
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		samples := make(map[string]pkg.InstanceMemory)
+		for pid, instance := range instances {
+			usage, err := pkg.SampleMemoryUsage(pkg.ProcessTree(children, pid))
+			if err != nil {
+				// the instance may have stopped since it was listed
+				continue
+			}
+			instance.MemoryUsage = usage
+			samples[instance.Address] = instance
+		}
+
+		instanceMemoryLock.Lock()
+		instanceMemory = samples
+		instanceMemoryLock.Unlock()
+	}
+}
+
+// Name of the runtime the hypervisor is running instances with
+func runtimeName() string {
+	switch ofhtype {
+	case MICROVM:
+		return "microvm"
+	case CLOUDHYPERVISOR:
+		return "cloud-hypervisor"
+	case CONTAINER:
+		return "container"
+	case PROCESS:
+		return "process"
+	default:
+		return "unikernel"
+	}
+}
+
 func preBoot(w http.ResponseWriter, r *http.Request) {
 	functionName := strings.TrimPrefix(r.URL.Path, "/preBoot/")
+	instancePool := readyFunctionInstances[functionName]
+	if instancePool == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Function not found"))
+		return
+	}
 	bodyBytes, err := io.ReadAll(r.Body)
 	if err != nil {
 		log.Printf("Failed to read number of vms to boot: %s", err.Error())
@@ -526,8 +2398,78 @@ func preBoot(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("Failed to read number of vms to boot"))
 		return
 	}
+	// only instances that became ready are added to the pool
 	for i := 0; i < number; i++ {
-		metadata := provisionFunctionInstance(functionName)
-		readyFunctionInstances[functionName].Put(metadata)
+		metadata := bootFunctionInstance(functionName)
+		if metadata != nil {
+			instancePool.Put(metadata)
+		}
+	}
+}
+
+// Pauses, resumes or reports the status of a single instance through QMP.
+// Expects /instance/<ip>/<pause|resume|status>. Paused instances are taken out
+// of their function's pool until they are resumed.
+func controlInstance(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/instance/"), "/")
+	if len(parts) != 2 {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Expected /instance/<ip>/<pause|resume|status>"))
+		return
+	}
+	functionInstanceMetadataLock.Lock()
+	metadata := functionInstanceMetadata[parts[0]]
+	functionInstanceMetadataLock.Unlock()
+	if metadata == nil {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Instance not found"))
+		return
+	}
+	if metadata.qmpSocket == "" {
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("Instance has no control channel"))
+		return
+	}
+
+	qmp, err := pkg.DialQmp(metadata.qmpSocket, time.Second)
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Failed to connect to instance"))
+		return
+	}
+	defer qmp.Close()
+
+	switch parts[1] {
+	case "pause":
+		holdPausedInstance(metadata)
+		_, err = qmp.Execute("stop", nil)
+		if err != nil {
+			releasePausedInstance(metadata)
+		}
+	case "resume":
+		_, err = qmp.Execute("cont", nil)
+		if err == nil {
+			releasePausedInstance(metadata)
+		}
+	case "status":
+		var status pkg.QmpStatus
+		status, err = qmp.QueryStatus()
+		if err == nil {
+			bytes, _ := json.Marshal(status)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(bytes)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Unknown action"))
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Failed to control instance"))
 	}
 }
@@ -0,0 +1,1021 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"openfaas-hypervisor/pkg"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	FaasProviderlogs "github.com/openfaas/faas-provider/logs"
+	FaasProvidertypes "github.com/openfaas/faas-provider/types"
+)
+
+// Deploys a function backed by runtime and removes it again, along with all of
+// its instances, when the test finishes
+func deployFakeFunction(t *testing.T, functionName string, runtime *fakeRuntime, manifest pkg.Manifest) {
+	t.Helper()
+	instanceRuntime = runtime
+	instanceLogs = pkg.NewInstanceLogs("", instanceLogLines, retainedInstanceLogs)
+	functionManifests[functionName] = &manifest
+	readyFunctionInstances[functionName] = newInstancePool(functionName)
+
+	t.Cleanup(func() {
+		stopAllFunctionInstances()
+		delete(readyFunctionInstances, functionName)
+		delete(functionManifests, functionName)
+		functionCrashesLock.Lock()
+		delete(functionCrashes, functionName)
+		functionCrashesLock.Unlock()
+		instanceRuntime = nil
+	})
+}
+
+func fakeManifest() pkg.Manifest {
+	return pkg.Manifest{Version: pkg.ManifestVersion, Runtime: pkg.RuntimeProcess, Readiness: pkg.Readiness{TimeoutSeconds: 5}}
+}
+
+func invoke(functionName string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/function/"+functionName, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	invokeFunction(w, req)
+	return w
+}
+
+func preBootInstances(functionName string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/preBoot/"+functionName, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	preBoot(w, req)
+	return w
+}
+
+func instanceCount() int {
+	functionInstanceMetadataLock.Lock()
+	defer functionInstanceMetadataLock.Unlock()
+	return len(functionInstanceMetadata)
+}
+
+// Waits up to a second for condition to hold
+func waitUntil(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within a second")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestInvokeFunction(t *testing.T) {
+	runtime := newFakeRuntime()
+	runtime.bootLatency = 10 * time.Millisecond
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+
+	for i := 0; i < 3; i++ {
+		w := invoke("echo", fmt.Sprintf("request %d", i))
+		if w.Code != http.StatusOK {
+			t.Fatalf("invocation %d returned %d: %s", i, w.Code, w.Body)
+		}
+		if w.Body.String() != fmt.Sprintf("request %d", i) {
+			t.Errorf("invocation %d returned %q", i, w.Body)
+		}
+	}
+
+	// the instance is returned to the pool after each invocation
+	if started, _ := runtime.counts(); started != 1 {
+		t.Errorf("expected 1 instance to be started, got %d", started)
+	}
+}
+
+func TestInvokeFunctionResponse(t *testing.T) {
+	runtime := newFakeRuntime()
+	runtime.response = "Hello World\n"
+	deployFakeFunction(t, "hello-world", runtime, fakeManifest())
+
+	w := invoke("hello-world", "")
+	if w.Code != http.StatusOK || w.Body.String() != "Hello World\n" {
+		t.Errorf("expected 200 Hello World, got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestInvokeUnknownFunction(t *testing.T) {
+	w := invoke("missing", "")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestInvokeFunctionConcurrently(t *testing.T) {
+	runtime := newFakeRuntime()
+	runtime.bootLatency = 5 * time.Millisecond
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+
+	const invocations = 50
+	var wg sync.WaitGroup
+	errs := make(chan string, invocations)
+	for i := 0; i < invocations; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := fmt.Sprintf("request %d", i)
+			w := invoke("echo", body)
+			if w.Code != http.StatusOK || w.Body.String() != body {
+				errs <- fmt.Sprintf("invocation %d returned %d %q", i, w.Code, w.Body)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	started, _ := runtime.counts()
+	if started < 1 || started > invocations {
+		t.Errorf("expected between 1 and %d instances to be started, got %d", invocations, started)
+	}
+}
+
+func TestInvokeFunctionWithoutReuse(t *testing.T) {
+	t.Setenv("DISABLE_VM_REUSE", "TRUE")
+	runtime := newFakeRuntime()
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+
+	for i := 0; i < 3; i++ {
+		if w := invoke("echo", "hi"); w.Code != http.StatusOK {
+			t.Fatalf("invocation %d returned %d", i, w.Code)
+		}
+	}
+	if started, _ := runtime.counts(); started != 3 {
+		t.Errorf("expected every invocation to start an instance, got %d", started)
+	}
+}
+
+func TestInstanceCrashesOnBoot(t *testing.T) {
+	runtime := newFakeRuntime()
+	runtime.crashOnBoot = true
+	manifest := fakeManifest()
+	manifest.Readiness.TimeoutSeconds = 1
+	deployFakeFunction(t, "crash", runtime, manifest)
+
+	w := invoke("crash", "")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+	// the instance that never became ready is cleaned up
+	if started, stopped := runtime.counts(); started != 1 || stopped != 1 {
+		t.Errorf("expected 1 instance started and stopped, got %d and %d", started, stopped)
+	}
+	if count := instanceCount(); count != 0 {
+		t.Errorf("expected no registered instances, got %d", count)
+	}
+}
+
+func TestRegisterInstanceReady(t *testing.T) {
+	metadata := &InstanceMetadata{
+		ip:             "172.44.0.99",
+		functionName:   "echo",
+		instanceId:     "test-instance",
+		readinessToken: "secret-token",
+		ready:          make(chan struct{}),
+		vmStartTime:    time.Now(),
+	}
+	registerFunctionInstance(metadata)
+	t.Cleanup(func() {
+		functionInstanceMetadataLock.Lock()
+		delete(functionInstanceMetadata, metadata.address())
+		functionInstanceMetadataLock.Unlock()
+		functionReadyConditions.Delete(metadata.address())
+	})
+
+	ready := func(remoteAddr string, token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/ready?token="+token, nil)
+		req.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		registerInstanceReady(w, req)
+		return w.Code
+	}
+	isReady := func() bool {
+		select {
+		case <-metadata.ready:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if code := ready("10.0.0.1:1234", "unknown-token"); code != http.StatusNotFound {
+		t.Errorf("expected %d for an unknown instance, got %d", http.StatusNotFound, code)
+	}
+	if code := ready("172.44.0.99:1234", "wrong-token"); code != http.StatusForbidden {
+		t.Errorf("expected %d for a wrong token, got %d", http.StatusForbidden, code)
+	}
+	if isReady() {
+		t.Fatal("instance became ready with a wrong token")
+	}
+	if code := ready("172.44.0.99:1234", "secret-token"); code != http.StatusOK {
+		t.Errorf("expected %d, got %d", http.StatusOK, code)
+	}
+	if !isReady() {
+		t.Error("instance did not become ready")
+	}
+	// a repeated call must not close the ready channel twice
+	if code := ready("172.44.0.99:1234", "secret-token"); code != http.StatusOK {
+		t.Errorf("expected %d for a repeated call, got %d", http.StatusOK, code)
+	}
+}
+
+func TestPreBoot(t *testing.T) {
+	runtime := newFakeRuntime()
+	runtime.bootLatency = 5 * time.Millisecond
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+
+	if w := preBootInstances("echo", "3"); w.Code != http.StatusOK {
+		t.Fatalf("preBoot returned %d: %s", w.Code, w.Body)
+	}
+	if started, _ := runtime.counts(); started != 3 {
+		t.Fatalf("expected 3 instances to be started, got %d", started)
+	}
+
+	// pre-booted instances are ready and serve invocations without booting more
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := invoke("echo", "hi"); w.Code != http.StatusOK {
+				t.Errorf("invocation returned %d", w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+	if started, _ := runtime.counts(); started != 3 {
+		t.Errorf("expected no more instances to be started, got %d", started)
+	}
+}
+
+func TestPreBootInvalidRequests(t *testing.T) {
+	runtime := newFakeRuntime()
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+
+	if w := preBootInstances("echo", "many"); w.Code != http.StatusInternalServerError {
+		t.Errorf("expected %d for an invalid count, got %d", http.StatusInternalServerError, w.Code)
+	}
+	if w := preBootInstances("missing", "1"); w.Code != http.StatusNotFound {
+		t.Errorf("expected %d for an unknown function, got %d", http.StatusNotFound, w.Code)
+	}
+	if started, _ := runtime.counts(); started != 0 {
+		t.Errorf("expected no instances to be started, got %d", started)
+	}
+}
+
+func TestShutdownStopsAllInstances(t *testing.T) {
+	runtime := newFakeRuntime()
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+
+	if w := preBootInstances("echo", "4"); w.Code != http.StatusOK {
+		t.Fatalf("preBoot returned %d", w.Code)
+	}
+	// an instance that is still booting is stopped too
+	runtime.setBootLatency(time.Hour)
+	booting, _ := provisionFunctionInstance("echo")
+
+	if count := instanceCount(); count != 5 {
+		t.Fatalf("expected 5 registered instances, got %d", count)
+	}
+	stopAllFunctionInstances()
+
+	if count := instanceCount(); count != 0 {
+		t.Errorf("expected no registered instances after shutdown, got %d", count)
+	}
+	if running := runtime.running(); running != 0 {
+		t.Errorf("expected all instances to be stopped, %d still running", running)
+	}
+	if _, loaded := functionReadyConditions.Load(booting.address()); loaded {
+		t.Error("ready condition of the booting instance was not removed")
+	}
+}
+
+// Limits request and response bodies for the duration of a test
+func setBodyLimits(t *testing.T, request int64, response int64) {
+	maxRequestBodyBytes, maxResponseBodyBytes = request, response
+	t.Cleanup(func() {
+		maxRequestBodyBytes, maxResponseBodyBytes = maxBodyBytes, maxBodyBytes
+	})
+}
+
+func TestInvokeFunctionRequestTooLarge(t *testing.T) {
+	setBodyLimits(t, 16, 0)
+	runtime := newFakeRuntime()
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+
+	// a known length is rejected before an instance is started
+	if w := invoke("echo", strings.Repeat("a", 17)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+	if started, _ := runtime.counts(); started != 0 {
+		t.Errorf("expected no instances to be started, got %d", started)
+	}
+
+	// a chunked body is cut off while it is streamed to the instance
+	runtime.handler = func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/function/echo", strings.NewReader(strings.Repeat("a", 64)))
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	invokeFunction(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected %d for a chunked body, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+	if started, stopped := runtime.counts(); started != 1 || stopped != 1 {
+		t.Errorf("expected the instance to be stopped, got %d started and %d stopped", started, stopped)
+	}
+
+	if w := invoke("echo", strings.Repeat("a", 16)); w.Code != http.StatusOK {
+		t.Errorf("expected a body at the limit to be accepted, got %d", w.Code)
+	}
+}
+
+func TestInvokeFunctionResponseTooLarge(t *testing.T) {
+	setBodyLimits(t, 0, 16)
+	runtime := newFakeRuntime()
+	runtime.response = strings.Repeat("a", 17)
+	deployFakeFunction(t, "large", runtime, fakeManifest())
+
+	if w := invoke("large", ""); w.Code != http.StatusBadGateway {
+		t.Errorf("expected %d, got %d", http.StatusBadGateway, w.Code)
+	}
+
+	// a chunked response is aborted once it exceeds the limit
+	runtime.handler = func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 4; i++ {
+			w.Write([]byte("0123456789"))
+			w.(http.Flusher).Flush()
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(invokeFunction))
+	defer server.Close()
+	res, err := http.Post(server.URL+"/function/large", "text/plain", nil)
+	if err == nil {
+		_, err = io.ReadAll(res.Body)
+		res.Body.Close()
+	}
+	if err == nil {
+		t.Error("expected a response over the limit to be aborted")
+	}
+}
+
+func TestInvokeFunctionStreamsEvents(t *testing.T) {
+	runtime := newFakeRuntime()
+	next := make(chan struct{})
+	runtime.handler = func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: event %d\n\n", i)
+			w.(http.Flusher).Flush()
+			<-next
+		}
+	}
+	deployFakeFunction(t, "events", runtime, fakeManifest())
+
+	server := httptest.NewServer(http.HandlerFunc(invokeFunction))
+	defer server.Close()
+	res, err := http.Post(server.URL+"/function/events", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if contentType := res.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("expected the event stream content type, got %q", contentType)
+	}
+
+	// every event arrives before the function sends the next one
+	reader := bufio.NewReader(res.Body)
+	for i := 0; i < 3; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != fmt.Sprintf("data: event %d\n", i) {
+			t.Errorf("expected event %d, got %q", i, line)
+		}
+		reader.ReadString('\n')
+		next <- struct{}{}
+	}
+}
+
+func TestInvokeFunctionForwardsRequest(t *testing.T) {
+	runtime := newFakeRuntime()
+	received := make(chan *http.Request, 1)
+	runtime.handler = func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+	}
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+
+	req := httptest.NewRequest(http.MethodPut, "http://gateway.local/function/echo/items/42?verbose=1&q=a+b", strings.NewReader("{}"))
+	req.RemoteAddr = "10.1.2.3:5555"
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", "192.0.2.1")
+	req.Header.Set("Connection", "close, X-Hop")
+	req.Header.Set("X-Hop", "dropped")
+	invokeFunction(httptest.NewRecorder(), req)
+
+	forwarded := <-received
+	if forwarded.Method != http.MethodPut {
+		t.Errorf("expected method %s, got %s", http.MethodPut, forwarded.Method)
+	}
+	if forwarded.URL.Path != "/invoke/items/42" || forwarded.URL.RawQuery != "verbose=1&q=a+b" {
+		t.Errorf("expected /invoke/items/42?verbose=1&q=a+b, got %s", forwarded.URL)
+	}
+	expectedHeaders := map[string]string{
+		"Content-Type":      "application/json",
+		"X-Forwarded-For":   "192.0.2.1, 10.1.2.3",
+		"X-Forwarded-Host":  "gateway.local",
+		"X-Forwarded-Proto": "http",
+		"X-Hop":             "",
+	}
+	for name, expected := range expectedHeaders {
+		if value := forwarded.Header.Get(name); value != expected {
+			t.Errorf("expected %s %q, got %q", name, expected, value)
+		}
+	}
+}
+
+func TestInvokeFunctionForwardsEscapedPath(t *testing.T) {
+	runtime := newFakeRuntime()
+	received := make(chan *http.Request, 1)
+	runtime.handler = func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+	}
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+
+	req := httptest.NewRequest(http.MethodGet, "/function/echo/a%3Fx=1/b%2Fc?q=1", nil)
+	invokeFunction(httptest.NewRecorder(), req)
+
+	// encoded characters are neither turned into a query nor into path separators
+	forwarded := <-received
+	if forwarded.URL.EscapedPath() != "/invoke/a%3Fx=1/b%2Fc" || forwarded.URL.RawQuery != "q=1" {
+		t.Errorf("expected /invoke/a%%3Fx=1/b%%2Fc?q=1, got %s", forwarded.URL)
+	}
+}
+
+func TestInvokeFunctionRelaysResponse(t *testing.T) {
+	runtime := newFakeRuntime()
+	runtime.handler = func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/invoke/old" {
+			http.Redirect(w, r, "/function/echo/new", http.StatusFound)
+			return
+		}
+		w.Header().Set("X-Function", "echo")
+		w.WriteHeader(http.StatusTeapot)
+		w.Write([]byte("short and stout"))
+	}
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+
+	w := invoke("echo", "")
+	if w.Code != http.StatusTeapot || w.Body.String() != "short and stout" {
+		t.Errorf("expected %d short and stout, got %d %q", http.StatusTeapot, w.Code, w.Body)
+	}
+	if value := w.Header().Get("X-Function"); value != "echo" {
+		t.Errorf("expected the function's headers to be relayed, got X-Function %q", value)
+	}
+
+	// redirects are relayed rather than followed
+	w = invoke("echo/old", "")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "/function/echo/new" {
+		t.Errorf("expected a redirect to /function/echo/new, got %d %q", w.Code, w.Header().Get("Location"))
+	}
+	// an error status doesn't make the instance unusable
+	if started, _ := runtime.counts(); started != 1 {
+		t.Errorf("expected the instance to be reused, got %d started", started)
+	}
+}
+
+func TestInvokeFunctionKeepAlive(t *testing.T) {
+	for _, keepAlive := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keepAlive=%t", keepAlive), func(t *testing.T) {
+			runtime := newFakeRuntime()
+			runtime.keepAlive = keepAlive
+			deployFakeFunction(t, "echo", runtime, fakeManifest())
+
+			before := stats.GetSamples()
+			for i := 0; i < 3; i++ {
+				if w := invoke("echo", "hi"); w.Code != http.StatusOK {
+					t.Fatalf("invocation %d returned %d", i, w.Code)
+				}
+			}
+
+			// only instances that negotiated keep-alive reuse their connection
+			expected := 3
+			if keepAlive {
+				expected = 1
+			}
+			if connections := runtime.connectionCount(); connections != expected {
+				t.Errorf("expected %d connections, got %d", expected, connections)
+			}
+			after := stats.GetSamples()
+			if recorded := len(after.ConnSetupTimeNano) - len(before.ConnSetupTimeNano); recorded != 3 {
+				t.Errorf("expected 3 connection setup samples, got %d", recorded)
+			}
+			if recorded := len(after.InstanceExecTimeNano) - len(before.InstanceExecTimeNano); recorded != 3 {
+				t.Errorf("expected 3 instance execution samples, got %d", recorded)
+			}
+		})
+	}
+}
+
+// Makes an instance hang on requests with the body "hang" until the caller
+// gives up on them
+func hangingHandler(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if string(body) == "hang" {
+		<-r.Context().Done()
+		return
+	}
+	w.Write(body)
+}
+
+func TestInvokeFunctionTimeout(t *testing.T) {
+	runtime := newFakeRuntime()
+	runtime.handler = hangingHandler
+	manifest := fakeManifest()
+	manifest.Annotations = map[string]string{pkg.ExecTimeoutAnnotation: "100ms"}
+	deployFakeFunction(t, "hang", runtime, manifest)
+
+	if w := invoke("hang", "hang"); w.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected %d, got %d", http.StatusGatewayTimeout, w.Code)
+	}
+	// the instance that timed out is killed rather than reused
+	if started, stopped := runtime.counts(); started != 1 || stopped != 1 {
+		t.Errorf("expected 1 instance started and stopped, got %d and %d", started, stopped)
+	}
+	if w := invoke("hang", "hi"); w.Code != http.StatusOK || w.Body.String() != "hi" {
+		t.Errorf("expected a replacement instance to respond, got %d %q", w.Code, w.Body)
+	}
+	if started, _ := runtime.counts(); started != 2 {
+		t.Errorf("expected a replacement instance to be started, got %d started", started)
+	}
+}
+
+func TestInvokeFunctionCallerGoesAway(t *testing.T) {
+	runtime := newFakeRuntime()
+	runtime.handler = hangingHandler
+	deployFakeFunction(t, "hang", runtime, fakeManifest())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodPost, "/function/hang", strings.NewReader("hang")).WithContext(ctx)
+	invokeFunction(httptest.NewRecorder(), req)
+
+	// the cancellation reaches the instance, which is stopped as it may still be busy
+	if started, stopped := runtime.counts(); started != 1 || stopped != 1 {
+		t.Errorf("expected 1 instance started and stopped, got %d and %d", started, stopped)
+	}
+}
+
+func TestFunctionExecTimeout(t *testing.T) {
+	runtime := newFakeRuntime()
+	manifest := fakeManifest()
+	manifest.Exec.TimeoutSeconds = 30
+	deployFakeFunction(t, "echo", runtime, manifest)
+	t.Cleanup(func() {
+		functionDeploymentsLock.Lock()
+		delete(functionDeployments, "echo")
+		functionDeploymentsLock.Unlock()
+	})
+
+	if timeout := functionExecTimeout("echo"); timeout != 30*time.Second {
+		t.Errorf("expected the manifest's timeout of 30s, got %s", timeout)
+	}
+
+	update := func(annotations string) int {
+		body := `{"service": "echo", "annotations": {"` + pkg.ExecTimeoutAnnotation + `": "` + annotations + `"}}`
+		w := httptest.NewRecorder()
+		updateFunction(w, httptest.NewRequest(http.MethodPut, "/system/functions", strings.NewReader(body)))
+		return w.Code
+	}
+	if code := update("2m"); code != http.StatusAccepted {
+		t.Fatalf("update returned %d", code)
+	}
+	if timeout := functionExecTimeout("echo"); timeout != 2*time.Minute {
+		t.Errorf("expected the deployment's annotation to override the manifest, got %s", timeout)
+	}
+	if code := update("45"); code != http.StatusAccepted {
+		t.Fatalf("update returned %d", code)
+	}
+	if timeout := functionExecTimeout("echo"); timeout != 45*time.Second {
+		t.Errorf("expected a timeout in seconds, got %s", timeout)
+	}
+	if code := update("soon"); code != http.StatusBadRequest {
+		t.Errorf("expected %d for an invalid timeout, got %d", http.StatusBadRequest, code)
+	}
+
+	// an invalid annotation that got past validation doesn't lift the limit
+	functionDeploymentsLock.Lock()
+	functionDeployments["echo"] = FaasProvidertypes.FunctionDeployment{Service: "echo", Annotations: &map[string]string{pkg.ExecTimeoutAnnotation: "soon"}}
+	functionDeploymentsLock.Unlock()
+	if timeout := functionExecTimeout("echo"); timeout != 30*time.Second {
+		t.Errorf("expected the manifest's timeout to be kept, got %s", timeout)
+	}
+}
+
+func TestInvokeFunctionRetriesCrashedInstance(t *testing.T) {
+	runtime := newFakeRuntime()
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+	if w := preBootInstances("echo", "1"); w.Code != http.StatusOK {
+		t.Fatalf("preBoot returned %d", w.Code)
+	}
+	runtime.crash(1)
+
+	// nothing reached the crashed instance, so the body is sent to a new one.
+	// A real server is used as its request bodies can't be read once closed.
+	server := httptest.NewServer(http.HandlerFunc(invokeFunction))
+	defer server.Close()
+	res, err := http.Post(server.URL+"/function/echo", "text/plain", strings.NewReader("hi"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "hi" {
+		t.Errorf("expected the invocation to be retried, got %d %q", res.StatusCode, body)
+	}
+	if started, stopped := runtime.counts(); started != 2 || stopped != 1 {
+		t.Errorf("expected the crashed instance to be replaced, got %d started and %d stopped", started, stopped)
+	}
+}
+
+func TestInvokeFunctionFailingInstances(t *testing.T) {
+	runtime := newFakeRuntime()
+	runtime.handler = func(w http.ResponseWriter, r *http.Request) {
+		// the instance dies in the middle of the invocation
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}
+	deployFakeFunction(t, "broken", runtime, fakeManifest())
+
+	// a body that reached the failed instance isn't sent again
+	if w := invoke("broken", "hi"); w.Code != http.StatusBadGateway {
+		t.Errorf("expected %d, got %d", http.StatusBadGateway, w.Code)
+	}
+	if started, stopped := runtime.counts(); started != 1 || stopped != 1 {
+		t.Errorf("expected no retry, got %d started and %d stopped", started, stopped)
+	}
+
+	// an invocation without a body is retried once
+	if w := invoke("broken", ""); w.Code != http.StatusBadGateway {
+		t.Errorf("expected %d, got %d", http.StatusBadGateway, w.Code)
+	}
+	if started, stopped := runtime.counts(); started != 3 || stopped != 3 {
+		t.Errorf("expected a single retry, got %d started and %d stopped", started, stopped)
+	}
+	if count := instanceCount(); count != 0 {
+		t.Errorf("expected failed instances to be unregistered, %d remain", count)
+	}
+}
+
+func TestProbeIdleInstances(t *testing.T) {
+	runtime := newFakeRuntime()
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+	if w := preBootInstances("echo", "3"); w.Code != http.StatusOK {
+		t.Fatalf("preBoot returned %d", w.Code)
+	}
+	runtime.crash(1)
+
+	probeIdleInstances(time.Now())
+
+	if started, stopped := runtime.counts(); started != 3 || stopped != 1 {
+		t.Errorf("expected the crashed instance to be stopped, got %d started and %d stopped", started, stopped)
+	}
+	// the healthy instances are back in the pool and serve invocations
+	for i := 0; i < 2; i++ {
+		if w := invoke("echo", "hi"); w.Code != http.StatusOK {
+			t.Errorf("invocation %d returned %d", i, w.Code)
+		}
+	}
+	if started, _ := runtime.counts(); started != 3 {
+		t.Errorf("expected the pooled instances to be used, got %d started", started)
+	}
+}
+
+func TestProbeSkipsRecentlyInvokedInstances(t *testing.T) {
+	runtime := newFakeRuntime()
+	runtime.keepAlive = true
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+
+	lastRound := time.Now()
+	if w := invoke("echo", "hi"); w.Code != http.StatusOK {
+		t.Fatalf("invocation returned %d", w.Code)
+	}
+	probeIdleInstances(lastRound)
+
+	// the kept-alive connection survives the probe and serves the next invocation
+	if w := invoke("echo", "hi"); w.Code != http.StatusOK {
+		t.Fatalf("invocation returned %d", w.Code)
+	}
+	if connections := runtime.connectionCount(); connections != 1 {
+		t.Errorf("expected the instance to be invoked over 1 connection, got %d", connections)
+	}
+
+	// an instance left idle for a whole round is probed again
+	probeIdleInstances(time.Now())
+	waitUntil(t, func() bool { return runtime.connectionCount() == 2 })
+}
+
+func TestInstanceExitIsReaped(t *testing.T) {
+	runtime := newFakeRuntime()
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+	if w := preBootInstances("echo", "2"); w.Code != http.StatusOK {
+		t.Fatalf("preBoot returned %d", w.Code)
+	}
+	runtime.exit(1, 3, "out of memory\n")
+
+	// the exited instance is unregistered and released without being invoked
+	waitUntil(t, func() bool { return runtime.running() == 1 })
+	if count := instanceCount(); count != 1 {
+		t.Errorf("expected the exited instance to be unregistered, %d remain", count)
+	}
+	crashes := currentCrashStats()["echo"]
+	if crashes.Count != 1 || crashes.LastExitCode != 3 || crashes.LastStderrTail != "out of memory\n" {
+		t.Errorf("unexpected crash stats %+v", crashes)
+	}
+
+	// its copy in the pool is skipped rather than invoked
+	for i := 0; i < 2; i++ {
+		if w := invoke("echo", "hi"); w.Code != http.StatusOK {
+			t.Errorf("invocation %d returned %d", i, w.Code)
+		}
+	}
+	if started, stopped := runtime.counts(); started != 2 || stopped != 1 {
+		t.Errorf("expected the remaining instance to be used, got %d started and %d stopped", started, stopped)
+	}
+
+	// instances the hypervisor stops didn't crash
+	stopAllFunctionInstances()
+	if crashes := currentCrashStats()["echo"]; crashes.Count != 1 {
+		t.Errorf("expected stopped instances not to count as crashes, got %d", crashes.Count)
+	}
+}
+
+func TestInstanceExitsWhileBooting(t *testing.T) {
+	runtime := newFakeRuntime()
+	runtime.bootLatency = time.Hour
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- invoke("echo", "")
+	}()
+	waitUntil(t, func() bool { return runtime.running() == 1 })
+	runtime.exit(1, 1, "")
+
+	// the invocation fails without waiting for the readiness timeout
+	select {
+	case w := <-done:
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("expected %d, got %d", http.StatusInternalServerError, w.Code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("invocation still waiting for the exited instance")
+	}
+	waitUntil(t, func() bool { return runtime.running() == 0 })
+	if count := instanceCount(); count != 0 {
+		t.Errorf("expected no registered instances, got %d", count)
+	}
+	if crashes := currentCrashStats()["echo"]; crashes.Count != 1 || crashes.LastExitCode != 1 {
+		t.Errorf("unexpected crash stats %+v", crashes)
+	}
+}
+
+// Requests the logs of a function from a test server, as /system/logs needs
+// a connection it can stream over
+func getLogs(t *testing.T, query string) (*http.Response, *json.Decoder) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(getFunctionLogs))
+	t.Cleanup(server.Close)
+	res, err := http.Get(server.URL + "/system/logs?" + query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { res.Body.Close() })
+	return res, json.NewDecoder(res.Body)
+}
+
+func readLogs(t *testing.T, query string) []FaasProviderlogs.Message {
+	t.Helper()
+	res, decoder := getLogs(t, query)
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("logs returned %d", res.StatusCode)
+	}
+	var messages []FaasProviderlogs.Message
+	for {
+		var message FaasProviderlogs.Message
+		if err := decoder.Decode(&message); err == io.EOF {
+			return messages
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, message)
+	}
+}
+
+func TestFunctionLogs(t *testing.T) {
+	runtime := newFakeRuntime()
+	deployFakeFunction(t, "logger", runtime, fakeManifest())
+	if w := preBootInstances("logger", "2"); w.Code != http.StatusOK {
+		t.Fatalf("preBoot returned %d", w.Code)
+	}
+	runtime.log("booted\r\n")
+	runtime.log("serving\n")
+
+	messages := readLogs(t, "name=logger")
+	if len(messages) != 4 {
+		t.Fatalf("expected 2 lines from each instance, got %+v", messages)
+	}
+	instances := make(map[string]bool)
+	for _, message := range messages {
+		instances[message.Instance] = true
+		if message.Name != "logger" || (message.Text != "booted" && message.Text != "serving") {
+			t.Errorf("unexpected message %+v", message)
+		}
+	}
+	if len(instances) != 2 {
+		t.Errorf("expected the lines of 2 instances, got %v", instances)
+	}
+
+	if messages := readLogs(t, "name=logger&tail=1"); len(messages) != 1 || messages[0].Text != "serving" {
+		t.Errorf("expected the last line, got %+v", messages)
+	}
+	since := time.Now().Add(time.Minute).Format(time.RFC3339)
+	if messages := readLogs(t, "name=logger&since="+since); len(messages) != 0 {
+		t.Errorf("expected no lines from the future, got %+v", messages)
+	}
+
+	// the logs of an instance that crashed remain available
+	runtime.exit(1, 1, "")
+	waitUntil(t, func() bool { return runtime.running() == 1 })
+	messages = readLogs(t, "name=logger")
+	if len(messages) != 4 {
+		t.Errorf("expected the crashed instance's lines to be kept, got %+v", messages)
+	}
+
+	if res, _ := getLogs(t, "name=missing"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected %d for an unknown function, got %d", http.StatusNotFound, res.StatusCode)
+	}
+}
+
+func TestFunctionLogsFollow(t *testing.T) {
+	runtime := newFakeRuntime()
+	deployFakeFunction(t, "logger", runtime, fakeManifest())
+	if w := preBootInstances("logger", "1"); w.Code != http.StatusOK {
+		t.Fatalf("preBoot returned %d", w.Code)
+	}
+	runtime.log("before\n")
+
+	res, decoder := getLogs(t, "name=logger&follow=true")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("logs returned %d", res.StatusCode)
+	}
+	var message FaasProviderlogs.Message
+	if err := decoder.Decode(&message); err != nil || message.Text != "before" {
+		t.Fatalf("expected the earlier line, got %+v, %v", message, err)
+	}
+	// lines written later are streamed as they arrive
+	runtime.log("after\n")
+	if err := decoder.Decode(&message); err != nil || message.Text != "after" {
+		t.Errorf("expected the followed line, got %+v, %v", message, err)
+	}
+}
+
+// Fails like the body of a caller that went away mid-upload
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func TestInvokeFunctionCallerBodyFails(t *testing.T) {
+	runtime := newFakeRuntime()
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+
+	req := httptest.NewRequest(http.MethodPost, "/function/echo", failingReader{})
+	req.ContentLength = -1
+	w := httptest.NewRecorder()
+	invokeFunction(w, req)
+
+	// the caller is at fault, so the invocation isn't retried on another instance
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	if started, _ := runtime.counts(); started != 1 {
+		t.Errorf("expected no retry, got %d started", started)
+	}
+}
+
+// Takes every instance out of a function's pool and puts them back, returning their IDs
+func pooledInstanceIds(functionName string) []string {
+	pool := readyFunctionInstances[functionName]
+	var instances []InstanceMetadata
+	for item := pool.TryGet(); item != nil; item = pool.TryGet() {
+		instances = append(instances, item.(InstanceMetadata))
+	}
+	var ids []string
+	for _, instance := range instances {
+		ids = append(ids, instance.instanceId)
+		pool.Put(instance)
+	}
+	return ids
+}
+
+func TestPausedInstancesAreHeldOutOfThePool(t *testing.T) {
+	runtime := newFakeRuntime()
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+	if w := preBootInstances("echo", "2"); w.Code != http.StatusOK {
+		t.Fatalf("preBoot returned %d", w.Code)
+	}
+
+	// an idle instance leaves the pool instead of being handed out once it is paused
+	idle, err := getReadyInstance("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseFunctionInstance(idle)
+	holdPausedInstance(&idle)
+	for i := 0; i < 2; i++ {
+		if w := invoke("echo", "hi"); w.Code != http.StatusOK {
+			t.Errorf("invocation returned %d", w.Code)
+		}
+	}
+	if ids := pooledInstanceIds("echo"); len(ids) != 1 || ids[0] == idle.instanceId {
+		t.Errorf("expected only the other instance to be pooled, got %v", ids)
+	}
+
+	// an instance in use is held back once its invocation releases it
+	busy, err := getReadyInstance("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	holdPausedInstance(&busy)
+	releaseFunctionInstance(busy)
+	if ids := pooledInstanceIds("echo"); len(ids) != 0 {
+		t.Errorf("expected no instances to be pooled while both are paused, got %v", ids)
+	}
+
+	// resumed instances are pooled again
+	releasePausedInstance(&idle)
+	releasePausedInstance(&busy)
+	if ids := pooledInstanceIds("echo"); len(ids) != 2 {
+		t.Errorf("expected both instances to be pooled after resuming, got %v", ids)
+	}
+	if started, _ := runtime.counts(); started != 2 {
+		t.Errorf("expected no instance to be booted in place of the paused ones, got %d started", started)
+	}
+}
+
+func TestPausedBootingInstanceIsNotHandedOut(t *testing.T) {
+	runtime := newFakeRuntime()
+	runtime.bootLatency = 50 * time.Millisecond
+	deployFakeFunction(t, "echo", runtime, fakeManifest())
+
+	// the invocation boots an instance, which is paused before it is ready
+	invoked := make(chan int)
+	go func() {
+		invoked <- invoke("echo", "hi").Code
+	}()
+	var booting *InstanceMetadata
+	waitUntil(t, func() bool {
+		functionInstanceMetadataLock.Lock()
+		defer functionInstanceMetadataLock.Unlock()
+		for _, metadata := range functionInstanceMetadata {
+			booting = metadata
+		}
+		return booting != nil
+	})
+	holdPausedInstance(booting)
+
+	if code := <-invoked; code != http.StatusOK {
+		t.Errorf("invocation returned %d", code)
+	}
+	if started, _ := runtime.counts(); started != 2 {
+		t.Errorf("expected another instance to serve the invocation, got %d started", started)
+	}
+	pausedInstancesLock.Lock()
+	held := pausedInstances[booting.instanceId]
+	pausedInstancesLock.Unlock()
+	if held == nil {
+		t.Error("expected the paused instance to be held back once ready")
+	}
+
+	releasePausedInstance(booting)
+	if ids := pooledInstanceIds("echo"); len(ids) != 2 {
+		t.Errorf("expected both instances to be pooled after resuming, got %v", ids)
+	}
+}
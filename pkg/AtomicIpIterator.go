@@ -8,14 +8,22 @@ import (
 type AtomicIpIterator struct {
 	ip    net.IP
 	mutex *sync.Mutex
+	// Addresses given back with Release, handed out again before new ones
+	released *[]string
 }
 
 func ParseIP(s string) AtomicIpIterator {
-	return AtomicIpIterator{net.ParseIP(s).To4(), &sync.Mutex{}}
+	return AtomicIpIterator{net.ParseIP(s).To4(), &sync.Mutex{}, &[]string{}}
 }
 
 func (i AtomicIpIterator) Next() string {
 	i.mutex.Lock()
+	if n := len(*i.released); n > 0 {
+		ip := (*i.released)[n-1]
+		*i.released = (*i.released)[:n-1]
+		i.mutex.Unlock()
+		return ip
+	}
 	if i.ip[3] != 255 {
 		i.ip[3]++
 	} else if i.ip[2] != 255 {
@@ -39,3 +47,10 @@ func (i AtomicIpIterator) Next() string {
 	i.mutex.Unlock()
 	return i.ip.String()
 }
+
+// Release makes an address returned by Next available again once nothing uses it
+func (i AtomicIpIterator) Release(ip string) {
+	i.mutex.Lock()
+	*i.released = append(*i.released, ip)
+	i.mutex.Unlock()
+}
@@ -0,0 +1,378 @@
+package pkg
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BenchConfig describes a benchmark run against a running hypervisor. The run
+// stops once Duration has passed or Requests requests have been sent,
+// whichever comes first.
+type BenchConfig struct {
+	Url      string `json:"url"`
+	Function string `json:"function"`
+	// Closed loop: number of clients each sending a request as soon as their last one completed
+	Concurrency int `json:"concurrency"`
+	// Open loop: mean requests per second, sent with Poisson arrivals regardless
+	// of how many are outstanding. 0 runs a closed loop.
+	Rate     float64       `json:"rate"`
+	Duration time.Duration `json:"durationNano"`
+	Requests int           `json:"requests"`
+	// Number of instances to boot through /preBoot before the run starts
+	PreBoot int           `json:"preBoot"`
+	Body    string        `json:"body"`
+	Timeout time.Duration `json:"timeoutNano"`
+	// How often to record the hypervisor's memory stats during the run, 0 to not record them
+	MemoryInterval time.Duration `json:"memoryIntervalNano"`
+}
+
+// BenchSample is a single request as seen by the client
+type BenchSample struct {
+	// Time the request was sent, relative to the start of the run
+	StartNano   int64  `json:"startNano"`
+	LatencyNano int64  `json:"latencyNano"`
+	Status      int    `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+// LatencySummary summarises a latency distribution. Percentiles are -1 when
+// there are no samples.
+type LatencySummary struct {
+	Count   int     `json:"count"`
+	AvgNano int64   `json:"avgNano"`
+	StdNano float64 `json:"stdNano"`
+	P50Nano int64   `json:"p50Nano"`
+	P95Nano int64   `json:"p95Nano"`
+	P99Nano int64   `json:"p99Nano"`
+	MaxNano int64   `json:"maxNano"`
+}
+
+type BenchClientResult struct {
+	Summary LatencySummary `json:"summary"`
+	Errors  int            `json:"errors"`
+	Samples []BenchSample  `json:"samples"`
+}
+
+// BenchMemorySample is the hypervisor's memory stats at a point during the run
+type BenchMemorySample struct {
+	TimeNano int64       `json:"timeNano"`
+	Stats    MemoryStats `json:"stats"`
+}
+
+type BenchServerResult struct {
+	Summary LatencySummary `json:"summary"`
+	Samples []int64        `json:"samples"`
+}
+
+// BenchResult holds the client side latencies of a run together with the
+// instance boot, connection setup and function execution times the hypervisor
+// recorded during it
+type BenchResult struct {
+	Config       BenchConfig         `json:"config"`
+	Client       BenchClientResult   `json:"client"`
+	VmInit       BenchServerResult   `json:"vmInit"`
+	FuncExec     BenchServerResult   `json:"funcExec"`
+	ConnSetup    BenchServerResult   `json:"connSetup"`
+	InstanceExec BenchServerResult   `json:"instanceExec"`
+	Memory       []BenchMemorySample `json:"memory,omitempty"`
+}
+
+// RunBench pre-boots instances if requested, drives /function/<name> as
+// described by config and collects the samples the hypervisor recorded meanwhile
+func RunBench(config BenchConfig) (*BenchResult, error) {
+	if config.Duration <= 0 && config.Requests <= 0 {
+		return nil, fmt.Errorf("Either a duration or a number of requests is required")
+	}
+	if config.Rate <= 0 && config.Concurrency <= 0 {
+		return nil, fmt.Errorf("Concurrency must be positive for a closed loop run")
+	}
+	config.Url = strings.TrimSuffix(config.Url, "/")
+	client := &http.Client{
+		Timeout:   config.Timeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: config.Concurrency},
+	}
+
+	if config.PreBoot > 0 {
+		err := benchPost(client, config.Url+"/preBoot/"+config.Function, strconv.Itoa(config.PreBoot))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to pre-boot instances: %s", err)
+		}
+	}
+
+	// instances booted by /preBoot are not part of the results
+	before, err := fetchStatsSamples(client, config.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	memory := make(chan []BenchMemorySample)
+	go func() {
+		memory <- recordMemory(client, config, done)
+	}()
+
+	var samples []BenchSample
+	if config.Rate > 0 {
+		samples = runOpenLoop(client, config)
+	} else {
+		samples = runClosedLoop(client, config)
+	}
+	close(done)
+
+	result := &BenchResult{Config: config, Memory: <-memory}
+	result.Client.Samples = samples
+	latencies := make([]int64, 0, len(samples))
+	for _, sample := range samples {
+		if sample.Error != "" || sample.Status != http.StatusOK {
+			result.Client.Errors++
+			continue
+		}
+		latencies = append(latencies, sample.LatencyNano)
+	}
+	result.Client.Summary = SummarizeLatencies(latencies)
+
+	// the hypervisor records an execution time just after responding, so
+	// give it a moment to catch up with the last requests
+	var after StatsSamples
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		after, err = fetchStatsSamples(client, config.Url)
+		if err != nil {
+			return nil, err
+		}
+		if len(after.FuncExecTimeNano)-len(before.FuncExecTimeNano) >= len(latencies) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	result.VmInit.Samples = samplesSince(after.VmInitTimeNano, len(before.VmInitTimeNano))
+	result.VmInit.Summary = SummarizeLatencies(result.VmInit.Samples)
+	result.FuncExec.Samples = samplesSince(after.FuncExecTimeNano, len(before.FuncExecTimeNano))
+	result.FuncExec.Summary = SummarizeLatencies(result.FuncExec.Samples)
+	result.ConnSetup.Samples = samplesSince(after.ConnSetupTimeNano, len(before.ConnSetupTimeNano))
+	result.ConnSetup.Summary = SummarizeLatencies(result.ConnSetup.Samples)
+	result.InstanceExec.Samples = samplesSince(after.InstanceExecTimeNano, len(before.InstanceExecTimeNano))
+	result.InstanceExec.Summary = SummarizeLatencies(result.InstanceExec.Samples)
+	return result, nil
+}
+
+// Returns the samples recorded after the first count
+func samplesSince(samples []int64, count int) []int64 {
+	if count > len(samples) {
+		return []int64{}
+	}
+	return samples[count:]
+}
+
+// Polls /stats/memory every MemoryInterval until done is closed
+func recordMemory(client *http.Client, config BenchConfig, done chan struct{}) []BenchMemorySample {
+	if config.MemoryInterval <= 0 {
+		return nil
+	}
+	start := time.Now()
+	ticker := time.NewTicker(config.MemoryInterval)
+	defer ticker.Stop()
+
+	var samples []BenchMemorySample
+	for {
+		var stats MemoryStats
+		err := benchGetJson(client, config.Url+"/stats/memory", &stats)
+		if err == nil {
+			samples = append(samples, BenchMemorySample{TimeNano: time.Since(start).Nanoseconds(), Stats: stats})
+		}
+		select {
+		case <-ticker.C:
+		case <-done:
+			return samples
+		}
+	}
+}
+
+func runClosedLoop(client *http.Client, config BenchConfig) []BenchSample {
+	start := time.Now()
+	deadline := start.Add(config.Duration)
+	var sent atomic.Int64
+	var samplesLock sync.Mutex
+	var samples []BenchSample
+
+	var wg sync.WaitGroup
+	for i := 0; i < config.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if config.Duration > 0 && time.Now().After(deadline) {
+					return
+				}
+				if config.Requests > 0 && sent.Add(1) > int64(config.Requests) {
+					return
+				}
+				sample := benchInvoke(client, config, start)
+				samplesLock.Lock()
+				samples = append(samples, sample)
+				samplesLock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return samples
+}
+
+func runOpenLoop(client *http.Client, config BenchConfig) []BenchSample {
+	start := time.Now()
+	deadline := start.Add(config.Duration)
+	rng := rand.New(rand.NewSource(start.UnixNano()))
+	var samplesLock sync.Mutex
+	var samples []BenchSample
+
+	var wg sync.WaitGroup
+	next := start
+	for i := 0; config.Requests <= 0 || i < config.Requests; i++ {
+		// exponentially distributed gaps between requests give Poisson arrivals
+		next = next.Add(time.Duration(rng.ExpFloat64() / config.Rate * float64(time.Second)))
+		if config.Duration > 0 && next.After(deadline) {
+			break
+		}
+		time.Sleep(time.Until(next))
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sample := benchInvoke(client, config, start)
+			samplesLock.Lock()
+			samples = append(samples, sample)
+			samplesLock.Unlock()
+		}()
+	}
+	wg.Wait()
+	return samples
+}
+
+func benchInvoke(client *http.Client, config BenchConfig, start time.Time) BenchSample {
+	requestStart := time.Now()
+	sample := BenchSample{StartNano: requestStart.Sub(start).Nanoseconds()}
+	res, err := client.Post(config.Url+"/function/"+config.Function, "text/plain", strings.NewReader(config.Body))
+	if err == nil {
+		// the latency includes reading the whole response
+		_, err = io.Copy(io.Discard, res.Body)
+		res.Body.Close()
+		sample.Status = res.StatusCode
+	}
+	sample.LatencyNano = time.Since(requestStart).Nanoseconds()
+	if err != nil {
+		sample.Error = err.Error()
+	}
+	return sample
+}
+
+func benchPost(client *http.Client, url string, body string) error {
+	res, err := client.Post(url, "text/plain", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("%s, %s", res.Status, message)
+	}
+	return nil
+}
+
+func fetchStatsSamples(client *http.Client, url string) (StatsSamples, error) {
+	var samples StatsSamples
+	err := benchGetJson(client, url+"/stats/samples", &samples)
+	if err != nil {
+		return samples, fmt.Errorf("Failed to fetch stats samples: %s", err)
+	}
+	return samples, nil
+}
+
+func benchGetJson(client *http.Client, url string, value any) error {
+	res, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", res.Status)
+	}
+	err = json.NewDecoder(res.Body).Decode(value)
+	if err != nil {
+		return fmt.Errorf("Failed to parse response: %s", err)
+	}
+	return nil
+}
+
+// SummarizeLatencies computes the summary of a latency distribution
+func SummarizeLatencies(latencies []int64) LatencySummary {
+	summary := LatencySummary{Count: len(latencies), AvgNano: -1, StdNano: -1, P50Nano: -1, P95Nano: -1, P99Nano: -1, MaxNano: -1}
+	if len(latencies) == 0 {
+		return summary
+	}
+
+	var sum int64
+	for _, latency := range latencies {
+		sum += latency
+	}
+	summary.AvgNano = sum / int64(len(latencies))
+	var variance float64
+	for _, latency := range latencies {
+		variance += math.Pow(float64(latency-summary.AvgNano), 2)
+	}
+	summary.StdNano = math.Sqrt(variance / float64(len(latencies)))
+
+	// sort a copy so the samples stay in the order they were recorded
+	sorted := append([]int64(nil), latencies...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	summary.P50Nano = sorted[int(float64(len(sorted))*0.50)]
+	summary.P95Nano = sorted[int(float64(len(sorted))*0.95)]
+	summary.P99Nano = sorted[int(float64(len(sorted))*0.99)]
+	summary.MaxNano = sorted[len(sorted)-1]
+	return summary
+}
+
+// WriteBenchCsv writes every sample of result as a row of
+// source,metric,start_nano,value,status,error. Values are latencies in
+// nanoseconds, except for memory samples of the benchmarked function which
+// are in KiB. Server side samples have no start time or status.
+func WriteBenchCsv(w io.Writer, result *BenchResult) error {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"source", "metric", "start_nano", "value", "status", "error"})
+	for _, sample := range result.Client.Samples {
+		writer.Write([]string{"client", "invoke", strconv.FormatInt(sample.StartNano, 10), strconv.FormatInt(sample.LatencyNano, 10), strconv.Itoa(sample.Status), sample.Error})
+	}
+	for _, latency := range result.VmInit.Samples {
+		writer.Write([]string{"server", "vm_init", "", strconv.FormatInt(latency, 10), "", ""})
+	}
+	for _, latency := range result.FuncExec.Samples {
+		writer.Write([]string{"server", "func_exec", "", strconv.FormatInt(latency, 10), "", ""})
+	}
+	for _, latency := range result.ConnSetup.Samples {
+		writer.Write([]string{"server", "conn_setup", "", strconv.FormatInt(latency, 10), "", ""})
+	}
+	for _, latency := range result.InstanceExec.Samples {
+		writer.Write([]string{"server", "instance_exec", "", strconv.FormatInt(latency, 10), "", ""})
+	}
+	for _, sample := range result.Memory {
+		usage := sample.Stats.Functions[result.Config.Function].Total
+		start := strconv.FormatInt(sample.TimeNano, 10)
+		writer.Write([]string{"memory", "rss_kib", start, strconv.FormatInt(usage.RssKiB, 10), "", ""})
+		writer.Write([]string{"memory", "pss_kib", start, strconv.FormatInt(usage.PssKiB, 10), "", ""})
+		writer.Write([]string{"memory", "wss_kib", start, strconv.FormatInt(usage.WssKiB, 10), "", ""})
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,36 @@
+package pkg
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSummarizeLatencies(t *testing.T) {
+	// more samples than fit in a uint16 counter, in reverse order
+	latencies := make([]int64, 70000)
+	for i := range latencies {
+		latencies[i] = int64(len(latencies) - i)
+	}
+	summary := SummarizeLatencies(latencies)
+
+	expected := LatencySummary{Count: 70000, AvgNano: 35000, P50Nano: 35001, P95Nano: 66501, P99Nano: 69301, MaxNano: 70000}
+	expected.StdNano = summary.StdNano
+	if summary != expected {
+		t.Errorf("expected %+v, got %+v", expected, summary)
+	}
+	// the standard deviation of 1..n is sqrt((n^2-1)/12)
+	if std := math.Sqrt((70000.0*70000.0 - 1) / 12); math.Abs(summary.StdNano-std) > 1 {
+		t.Errorf("expected a standard deviation of %f, got %f", std, summary.StdNano)
+	}
+	if latencies[0] != 70000 {
+		t.Error("expected the samples to be left in the order they were recorded")
+	}
+}
+
+func TestSummarizeNoLatencies(t *testing.T) {
+	summary := SummarizeLatencies(nil)
+	expected := LatencySummary{Count: 0, AvgNano: -1, StdNano: -1, P50Nano: -1, P95Nano: -1, P99Nano: -1, MaxNano: -1}
+	if summary != expected {
+		t.Errorf("expected %+v, got %+v", expected, summary)
+	}
+}
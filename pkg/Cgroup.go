@@ -0,0 +1,334 @@
+package pkg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	CgroupRoot      = "/sys/fs/cgroup"
+	cgroupCpuPeriod = 100000
+	// Leaf cgroup the hypervisor moves itself to when controllers can't be
+	// enabled for the children of its own cgroup otherwise
+	hypervisorCgroupName = "hypervisor"
+)
+
+// Cgroup is a cgroup v2 group. Its directory is kept open so processes can be
+// started directly inside it where the kernel supports it.
+type Cgroup struct {
+	path      string
+	dir       *os.File
+	cloneInto bool
+}
+
+// CgroupStats are the CPU and memory counters of a cgroup
+type CgroupStats struct {
+	CpuUsageUsec     int64 `json:"cpuUsageUsec"`
+	CpuUserUsec      int64 `json:"cpuUserUsec"`
+	CpuSystemUsec    int64 `json:"cpuSystemUsec"`
+	CpuPeriods       int64 `json:"cpuPeriods"`
+	CpuThrottled     int64 `json:"cpuThrottled"`
+	CpuThrottledUsec int64 `json:"cpuThrottledUsec"`
+	MemoryBytes      int64 `json:"memoryBytes"`
+	MemoryAnonBytes  int64 `json:"memoryAnonBytes"`
+	MemoryFileBytes  int64 `json:"memoryFileBytes"`
+	OomKills         int64 `json:"oomKills"`
+}
+
+func (s CgroupStats) Add(other CgroupStats) CgroupStats {
+	return CgroupStats{
+		CpuUsageUsec:     s.CpuUsageUsec + other.CpuUsageUsec,
+		CpuUserUsec:      s.CpuUserUsec + other.CpuUserUsec,
+		CpuSystemUsec:    s.CpuSystemUsec + other.CpuSystemUsec,
+		CpuPeriods:       s.CpuPeriods + other.CpuPeriods,
+		CpuThrottled:     s.CpuThrottled + other.CpuThrottled,
+		CpuThrottledUsec: s.CpuThrottledUsec + other.CpuThrottledUsec,
+		MemoryBytes:      s.MemoryBytes + other.MemoryBytes,
+		MemoryAnonBytes:  s.MemoryAnonBytes + other.MemoryAnonBytes,
+		MemoryFileBytes:  s.MemoryFileBytes + other.MemoryFileBytes,
+		OomKills:         s.OomKills + other.OomKills,
+	}
+}
+
+// InstanceCgroupStats are the cgroup counters of a running instance
+type InstanceCgroupStats struct {
+	Address    string `json:"address"`
+	Function   string `json:"function"`
+	InstanceId string `json:"instanceId"`
+	CgroupStats
+}
+
+// FunctionCgroupStats sums the cgroup counters of a function's instances. CPU
+// counters and OOM kills include instances that have stopped, memory only
+// covers running instances.
+type FunctionCgroupStats struct {
+	RunningInstances int `json:"runningInstances"`
+	CgroupStats
+}
+
+type CgroupStatsReport struct {
+	Functions map[string]FunctionCgroupStats `json:"functions"`
+	Instances []InstanceCgroupStats          `json:"instances"`
+}
+
+// NewCgroupSlice creates the cgroup the hypervisor places instances under,
+// below the hypervisor's own cgroup, with the cpu and memory controllers
+// enabled for its children. Only cgroups without processes can enable
+// controllers for their children. When the hypervisor's cgroup is delegated to
+// it, or it is a container's init, it moves itself to a leaf cgroup for that,
+// but it never moves other processes.
+func NewCgroupSlice(name string) (*Cgroup, error) {
+	if _, err := os.Stat(filepath.Join(CgroupRoot, "cgroup.controllers")); err != nil {
+		return nil, fmt.Errorf("%s is not a cgroup v2 hierarchy", CgroupRoot)
+	}
+	parent, err := ownCgroup()
+	if err != nil {
+		return nil, err
+	}
+	err = enableCgroupControllers(parent)
+	if errors.Is(err, syscall.EBUSY) {
+		err = enableControllersFromLeaf(parent)
+	}
+	if err != nil {
+		return nil, err
+	}
+	slice, err := newCgroup(filepath.Join(parent, name))
+	if err != nil {
+		return nil, err
+	}
+	slice.cloneInto = cloneIntoCgroupSupported()
+	err = enableCgroupControllers(slice.path)
+	if err != nil {
+		slice.Remove()
+		return nil, err
+	}
+	return slice, nil
+}
+
+func enableCgroupControllers(path string) error {
+	err := os.WriteFile(filepath.Join(path, "cgroup.subtree_control"), []byte("+cpu +memory"), 0)
+	if err != nil {
+		return fmt.Errorf("Failed to enable cpu and memory controllers in %s: %w", path, err)
+	}
+	return nil
+}
+
+// Returns the path of the cgroup the hypervisor runs in
+func ownCgroup() (string, error) {
+	content, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", fmt.Errorf("Failed to read the hypervisor's cgroup: %s", err)
+	}
+	// the cgroup v2 hierarchy is listed as "0::<path>"
+	for _, line := range strings.Split(string(content), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			return filepath.Join(CgroupRoot, path), nil
+		}
+	}
+	return "", fmt.Errorf("The hypervisor is not in a cgroup v2 hierarchy")
+}
+
+// Moves the hypervisor out of the cgroup at parent so controllers can be
+// enabled for its children, moving it back when they still can't be
+func enableControllersFromLeaf(parent string) error {
+	if os.Getpid() != 1 && !cgroupDelegated(parent) {
+		return fmt.Errorf("Cannot enable cpu and memory controllers in %s as it has processes of its own. Run the hypervisor in a cgroup delegated to it, e.g. from a systemd unit with Delegate=yes, or as a container's init", parent)
+	}
+	leaf := filepath.Join(parent, hypervisorCgroupName)
+	err := os.Mkdir(leaf, 0755)
+	if err != nil && !errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("Failed to create cgroup %s: %s", leaf, err)
+	}
+	err = moveToCgroup(leaf, os.Getpid())
+	if err != nil {
+		return err
+	}
+	err = enableCgroupControllers(parent)
+	if err != nil {
+		// other processes still use the cgroup
+		moveToCgroup(parent, os.Getpid())
+		os.Remove(leaf)
+		return err
+	}
+	return nil
+}
+
+// Whether systemd delegated the cgroup at path, letting its processes manage
+// the cgroups below it
+func cgroupDelegated(path string) bool {
+	for _, attr := range []string{"trusted.delegate", "user.delegate"} {
+		if _, err := unix.Getxattr(path, attr, nil); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func moveToCgroup(path string, pid int) error {
+	err := os.WriteFile(filepath.Join(path, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0)
+	if err != nil {
+		return fmt.Errorf("Failed to move process %d to cgroup %s: %s", pid, path, err)
+	}
+	return nil
+}
+
+// Whether the kernel can start processes inside a cgroup, which needs
+// CLONE_INTO_CGROUP from Linux 5.7
+func cloneIntoCgroupSupported() bool {
+	var uname unix.Utsname
+	if unix.Uname(&uname) != nil {
+		return false
+	}
+	var major, minor int
+	_, err := fmt.Sscanf(unix.ByteSliceToString(uname.Release[:]), "%d.%d", &major, &minor)
+	return err == nil && (major > 5 || (major == 5 && minor >= 7))
+}
+
+func newCgroup(path string) (*Cgroup, error) {
+	err := os.Mkdir(path, 0755)
+	if err != nil && !errors.Is(err, fs.ErrExist) {
+		return nil, fmt.Errorf("Failed to create cgroup %s: %s", path, err)
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("Failed to open cgroup %s: %s", path, err)
+	}
+	return &Cgroup{path: path, dir: dir}, nil
+}
+
+// NewChild creates a cgroup below c limited to resources
+func (c *Cgroup) NewChild(name string, resources Resources) (*Cgroup, error) {
+	child, err := newCgroup(filepath.Join(c.path, name))
+	if err != nil {
+		return nil, err
+	}
+	child.cloneInto = c.cloneInto
+
+	if resources.CpuMillicores > 0 {
+		quota := resources.CpuMillicores * cgroupCpuPeriod / 1000
+		err = child.write("cpu.max", fmt.Sprintf("%d %d", quota, cgroupCpuPeriod))
+	}
+	if err == nil && resources.MemoryMiB > 0 {
+		err = child.write("memory.max", strconv.FormatInt(resources.MemoryMiB*1024*1024, 10))
+	}
+	if err != nil {
+		child.Remove()
+		return nil, err
+	}
+	return child, nil
+}
+
+// Path returns the path of the cgroup relative to the cgroup root, as used by
+// the cgroupsPath of an OCI spec
+func (c *Cgroup) Path() string {
+	return strings.TrimPrefix(c.path, CgroupRoot)
+}
+
+// SysProcAttr makes a command start inside the cgroup, so every process it
+// forks is accounted to the cgroup from the start. It is nil when the kernel
+// can't do that, the command must then be added with AddProcesses once started.
+func (c *Cgroup) SysProcAttr() *syscall.SysProcAttr {
+	if !c.cloneInto {
+		return nil
+	}
+	return &syscall.SysProcAttr{UseCgroupFD: true, CgroupFD: int(c.dir.Fd())}
+}
+
+// Whether commands given SysProcAttr start inside the cgroup
+func (c *Cgroup) StartsProcesses() bool {
+	return c.cloneInto
+}
+
+// AddProcesses moves already running processes into the cgroup
+func (c *Cgroup) AddProcesses(pids []int) error {
+	for _, pid := range pids {
+		err := c.write("cgroup.procs", strconv.Itoa(pid))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cgroup) Stats() (CgroupStats, error) {
+	var stats CgroupStats
+	cpu, err := c.readKeyedFile("cpu.stat")
+	if err != nil {
+		return stats, err
+	}
+	memory, err := c.readKeyedFile("memory.stat")
+	if err != nil {
+		return stats, err
+	}
+	events, err := c.readKeyedFile("memory.events")
+	if err != nil {
+		return stats, err
+	}
+	current, err := os.ReadFile(filepath.Join(c.path, "memory.current"))
+	if err != nil {
+		return stats, fmt.Errorf("Failed to read cgroup memory usage: %s", err)
+	}
+
+	stats.CpuUsageUsec = cpu["usage_usec"]
+	stats.CpuUserUsec = cpu["user_usec"]
+	stats.CpuSystemUsec = cpu["system_usec"]
+	stats.CpuPeriods = cpu["nr_periods"]
+	stats.CpuThrottled = cpu["nr_throttled"]
+	stats.CpuThrottledUsec = cpu["throttled_usec"]
+	stats.MemoryBytes, _ = strconv.ParseInt(strings.TrimSpace(string(current)), 10, 64)
+	stats.MemoryAnonBytes = memory["anon"]
+	stats.MemoryFileBytes = memory["file"]
+	stats.OomKills = events["oom_kill"]
+	return stats, nil
+}
+
+// Remove deletes the cgroup, which must not contain any processes
+func (c *Cgroup) Remove() error {
+	c.dir.Close()
+	err := os.Remove(c.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Failed to remove cgroup %s: %s", c.path, err)
+	}
+	return nil
+}
+
+func (c *Cgroup) write(file string, value string) error {
+	err := os.WriteFile(filepath.Join(c.path, file), []byte(value), 0)
+	if err != nil {
+		return fmt.Errorf("Failed to write %s of cgroup %s: %s", file, c.path, err)
+	}
+	return nil
+}
+
+// Reads a file of "key value" lines such as cpu.stat
+func (c *Cgroup) readKeyedFile(file string) (map[string]int64, error) {
+	f, err := os.Open(filepath.Join(c.path, file))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s of cgroup %s: %s", file, c.path, err)
+	}
+	defer f.Close()
+
+	values := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err == nil {
+			values[fields[0]] = value
+		}
+	}
+	return values, scanner.Err()
+}
@@ -0,0 +1,126 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// CloudHypervisorVmConfig is the subset of the Cloud Hypervisor vm.create
+// body used to boot function instances
+type CloudHypervisorVmConfig struct {
+	Cpus    CloudHypervisorCpus    `json:"cpus"`
+	Memory  CloudHypervisorMemory  `json:"memory"`
+	Payload CloudHypervisorPayload `json:"payload"`
+	Disks   []CloudHypervisorDisk  `json:"disks"`
+	Net     []CloudHypervisorNet   `json:"net,omitempty"`
+	Serial  CloudHypervisorConsole `json:"serial"`
+	Console CloudHypervisorConsole `json:"console"`
+}
+
+type CloudHypervisorCpus struct {
+	BootVcpus int `json:"boot_vcpus"`
+	MaxVcpus  int `json:"max_vcpus"`
+}
+
+type CloudHypervisorMemory struct {
+	Size int64 `json:"size"`
+}
+
+type CloudHypervisorPayload struct {
+	Kernel  string `json:"kernel"`
+	Cmdline string `json:"cmdline"`
+}
+
+type CloudHypervisorDisk struct {
+	Path     string `json:"path"`
+	Readonly bool   `json:"readonly"`
+}
+
+type CloudHypervisorNet struct {
+	Tap string `json:"tap"`
+	Mac string `json:"mac"`
+}
+
+type CloudHypervisorConsole struct {
+	Mode string `json:"mode"`
+	File string `json:"file,omitempty"`
+}
+
+// CloudHypervisorClient talks to the REST API of a single Cloud Hypervisor process
+type CloudHypervisorClient struct {
+	socketPath string
+	client     *http.Client
+}
+
+func NewCloudHypervisorClient(socketPath string) *CloudHypervisorClient {
+	return &CloudHypervisorClient{
+		socketPath: socketPath,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// WaitForSocket waits for the API socket to appear after the process is started
+func (c *CloudHypervisorClient) WaitForSocket(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(c.socketPath); err == nil {
+			return nil
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return fmt.Errorf("Cloud Hypervisor API socket %s did not appear within %s", c.socketPath, timeout)
+}
+
+func (c *CloudHypervisorClient) CreateVm(config CloudHypervisorVmConfig) error {
+	return c.put("vm.create", config)
+}
+
+func (c *CloudHypervisorClient) BootVm() error {
+	return c.put("vm.boot", nil)
+}
+
+// ShutdownVmm shuts down the VM and stops the Cloud Hypervisor process
+func (c *CloudHypervisorClient) ShutdownVmm() error {
+	return c.put("vmm.shutdown", nil)
+}
+
+func (c *CloudHypervisorClient) put(endpoint string, body any) error {
+	var bodyReader io.Reader = http.NoBody
+	if body != nil {
+		bodyBytes, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("Failed to marshal %s request: %s", endpoint, err)
+		}
+		bodyReader = bytes.NewReader(bodyBytes)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, "http://localhost/api/v1/"+endpoint, bodyReader)
+	if err != nil {
+		return fmt.Errorf("Failed to create %s request: %s", endpoint, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Cloud Hypervisor %s request failed: %s", endpoint, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		message, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("Cloud Hypervisor %s request failed: %s, %s", endpoint, res.Status, message)
+	}
+	return nil
+}
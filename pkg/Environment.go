@@ -0,0 +1,112 @@
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const DefaultSecretsDir = "/var/openfaas/secrets"
+
+// Prefix of the kernel parameters a microVM guest reads its environment from,
+// keeping variables apart from the parameters of the kernel and init
+const GuestEnvParamPrefix = "ofh.env."
+
+// ReadSecret reads the value of the named secret from dir. The returned error
+// never contains the secret's value.
+func ReadSecret(dir string, name string) (string, error) {
+	if !ValidSecretName(name) {
+		return "", fmt.Errorf("Invalid secret name %q", name)
+	}
+	value, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return "", fmt.Errorf("Failed to read secret %s: %s", name, err)
+	}
+	return strings.TrimRight(string(value), "\n"), nil
+}
+
+// ValidSecretName reports whether name can be used as a secret file name
+func ValidSecretName(name string) bool {
+	return name != "" && name == filepath.Base(name) && !strings.HasPrefix(name, ".")
+}
+
+// ValidEnvName reports whether name can be used as an environment variable name
+func ValidEnvName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "= \t\n")
+}
+
+// SecretEnvName returns the environment variable a secret is exposed as,
+// e.g. "db-password" becomes "SECRET_DB_PASSWORD".
+func SecretEnvName(name string) string {
+	envName := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+	return "SECRET_" + strings.ToUpper(envName)
+}
+
+// EnvList converts env into a list of NAME=value strings sorted by name
+func EnvList(env map[string]string) []string {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list := make([]string, 0, len(env))
+	for _, name := range names {
+		list = append(list, name+"="+env[name])
+	}
+	return list
+}
+
+// CheckKernelCmdlineEnv reports an error for the first variable of env whose
+// value contains whitespace or quotes, which the kernel command line cannot
+// carry reliably, or whose name the guest can't export from a shell. The
+// error never contains the value.
+func CheckKernelCmdlineEnv(env map[string]string) error {
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !shellVariableName(name) {
+			return fmt.Errorf("%s cannot be passed on the kernel command line as it is not a valid shell variable name", name)
+		}
+		if strings.ContainsAny(env[name], " \t\n\"") {
+			return fmt.Errorf("Value of %s cannot be passed on the kernel command line as it contains whitespace or quotes", name)
+		}
+	}
+	return nil
+}
+
+// KernelCmdlineEnv formats env as space separated NAME=value kernel
+// parameters. env must have passed CheckKernelCmdlineEnv.
+func KernelCmdlineEnv(env map[string]string) string {
+	return strings.Join(EnvList(env), " ")
+}
+
+// GuestKernelCmdlineEnv formats env as space separated ofh.env.NAME=value
+// kernel parameters, which a microVM's ready.sh exports. env must have passed
+// CheckKernelCmdlineEnv.
+func GuestKernelCmdlineEnv(env map[string]string) string {
+	params := EnvList(env)
+	for i, param := range params {
+		params[i] = GuestEnvParamPrefix + param
+	}
+	return strings.Join(params, " ")
+}
+
+func shellVariableName(name string) bool {
+	for i, r := range name {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && r >= '0' && r <= '9')) {
+			return false
+		}
+	}
+	return name != ""
+}
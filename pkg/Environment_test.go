@@ -0,0 +1,40 @@
+package pkg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckKernelCmdlineEnv(t *testing.T) {
+	if err := CheckKernelCmdlineEnv(map[string]string{"A": "1", "B": "x=y,z"}); err != nil {
+		t.Errorf("expected plain values to be accepted, got %s", err)
+	}
+	for _, value := range []string{"hello world", "a\tb", "a\nb", `say "hi"`} {
+		err := CheckKernelCmdlineEnv(map[string]string{"A": "1", "SECRET_KEY": value})
+		if err == nil {
+			t.Errorf("expected %q to be rejected", value)
+			continue
+		}
+		// secrets are checked too, so the error must not leak the value
+		if !strings.Contains(err.Error(), "SECRET_KEY") || strings.Contains(err.Error(), value) {
+			t.Errorf("expected an error naming SECRET_KEY without its value, got %q", err)
+		}
+	}
+	for _, name := range []string{"1A", "A-B", "A.B"} {
+		if err := CheckKernelCmdlineEnv(map[string]string{name: "1"}); err == nil {
+			t.Errorf("expected name %q to be rejected", name)
+		}
+	}
+}
+
+func TestKernelCmdlineEnv(t *testing.T) {
+	if got := KernelCmdlineEnv(map[string]string{"B": "2", "A": "1"}); got != "A=1 B=2" {
+		t.Errorf("expected %q, got %q", "A=1 B=2", got)
+	}
+}
+
+func TestGuestKernelCmdlineEnv(t *testing.T) {
+	if got := GuestKernelCmdlineEnv(map[string]string{"root": "x", "A": "1"}); got != "ofh.env.A=1 ofh.env.root=x" {
+		t.Errorf("expected %q, got %q", "ofh.env.A=1 ofh.env.root=x", got)
+	}
+}
@@ -0,0 +1,355 @@
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/openfaas/faas-provider/logs"
+)
+
+// Longest line kept whole, longer output without a newline is split
+const MaxLogLineBytes = 16 * 1024
+
+// Size an instance's log file may grow to, later lines are only kept in memory
+const MaxLogFileBytes = 64 * 1024 * 1024
+
+// Lines a follower may fall behind by before further lines are dropped for it
+const logFollowerBacklog = 256
+
+// LogLine is a line of an instance's console or VMM output, numbered in the
+// order the instance wrote it
+type LogLine struct {
+	Seq  int64
+	Time time.Time
+	Text string
+}
+
+// LogBuffer splits an instance's output into timestamped lines, keeping the
+// latest of them in memory and appending them to a file until it reaches
+// MaxLogFileBytes. It is safe for concurrent use.
+type LogBuffer struct {
+	lock      sync.Mutex
+	lines     []LogLine
+	seq       int64
+	partial   []byte
+	path      string
+	file      *os.File
+	fileBytes int64
+	fileLimit int64
+	closed    bool
+	onLine    func(LogLine)
+}
+
+// NewLogBuffer keeps the latest size lines, writing them all to path as well
+// unless it is empty. onLine is called with every line in order, it must not block.
+func NewLogBuffer(size int, path string, onLine func(LogLine)) (*LogBuffer, error) {
+	buffer := &LogBuffer{lines: make([]LogLine, 0, size), path: path, fileLimit: MaxLogFileBytes, onLine: onLine}
+	if path != "" {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create instance log: %s", err)
+		}
+		buffer.file = file
+	}
+	return buffer, nil
+}
+
+// Write never fails, a file that can't be written to only loses its copy of the lines
+func (b *LogBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.partial = append(b.partial, p...)
+	for {
+		end := bytes.IndexByte(b.partial, '\n')
+		if end < 0 {
+			break
+		}
+		b.addLine(now, b.partial[:end])
+		b.partial = b.partial[end+1:]
+	}
+	for len(b.partial) > MaxLogLineBytes {
+		b.addLine(now, b.partial[:MaxLogLineBytes])
+		b.partial = b.partial[MaxLogLineBytes:]
+	}
+	// don't keep a large backing array alive for a short partial line
+	b.partial = append([]byte{}, b.partial...)
+	return len(p), nil
+}
+
+// Must be called with the lock held
+func (b *LogBuffer) addLine(now time.Time, text []byte) {
+	// serial consoles end their lines with \r\n
+	line := LogLine{Seq: b.seq, Time: now, Text: string(bytes.TrimSuffix(text, []byte("\r")))}
+	b.seq++
+	if len(b.lines) < cap(b.lines) {
+		b.lines = append(b.lines, line)
+	} else if cap(b.lines) > 0 {
+		b.lines[line.Seq%int64(cap(b.lines))] = line
+	}
+	if b.file != nil && !b.closed && b.fileBytes < b.fileLimit {
+		timestamp := line.Time.UTC().Format(time.RFC3339Nano)
+		entry := fmt.Sprintf("%s %s\n", timestamp, line.Text)
+		// room is left for noting the truncation within the limit
+		truncation := fmt.Sprintf("%s log file truncated at %d bytes\n", timestamp, b.fileLimit)
+		full := b.fileBytes+int64(len(entry)+len(truncation)) > b.fileLimit
+		if full {
+			entry = truncation
+		}
+		n, _ := b.file.WriteString(entry)
+		b.fileBytes += int64(n)
+		// nothing is written after the truncation is noted
+		if full {
+			b.fileBytes = b.fileLimit
+		}
+	}
+	if b.onLine != nil {
+		b.onLine(line)
+	}
+}
+
+// Lines returns the lines kept in memory, oldest first
+func (b *LogBuffer) Lines() []LogLine {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.lines) < cap(b.lines) || cap(b.lines) == 0 {
+		return append([]LogLine{}, b.lines...)
+	}
+	start := b.seq % int64(cap(b.lines))
+	return append(append([]LogLine{}, b.lines[start:]...), b.lines[:start]...)
+}
+
+// Close ends the last line and closes the file once the instance is stopped
+func (b *LogBuffer) Close() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.closed {
+		return nil
+	}
+	if len(b.partial) > 0 {
+		b.addLine(time.Now(), b.partial)
+		b.partial = nil
+	}
+	b.closed = true
+	if b.file == nil {
+		return nil
+	}
+	return b.file.Close()
+}
+
+// Whether the instance the buffer belongs to was stopped
+func (b *LogBuffer) Closed() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.closed
+}
+
+// Deletes the file of a stopped instance's log
+func (b *LogBuffer) removeFile() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.path == "" {
+		return nil
+	}
+	err := os.Remove(b.path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Failed to remove instance log: %s", err)
+	}
+	return nil
+}
+
+// InstanceLogs keeps the logs of every function instance and serves them to
+// the faas-provider logs handler. The logs of a stopped instance, and their
+// file, are kept until more than retain instances of its function have stopped.
+type InstanceLogs struct {
+	dir    string
+	size   int
+	retain int
+
+	lock      sync.Mutex
+	functions map[string][]*instanceLog
+
+	followersLock sync.Mutex
+	followers     map[*logFollower]struct{}
+}
+
+type instanceLog struct {
+	instance string
+	buffer   *LogBuffer
+}
+
+type logFollower struct {
+	function string
+	instance string
+	lines    chan followedLine
+}
+
+type followedLine struct {
+	instance string
+	line     LogLine
+}
+
+// NewInstanceLogs keeps size lines of each instance in memory, and all of them
+// in files under dir unless it is empty
+func NewInstanceLogs(dir string, size int, retain int) *InstanceLogs {
+	return &InstanceLogs{
+		dir:       dir,
+		size:      size,
+		retain:    retain,
+		functions: make(map[string][]*instanceLog),
+		followers: make(map[*logFollower]struct{}),
+	}
+}
+
+// Open creates the log of a new instance, stored in <dir>/<function>/<instance>.log
+func (l *InstanceLogs) Open(function string, instance string) (*LogBuffer, error) {
+	path := ""
+	if l.dir != "" {
+		err := os.MkdirAll(filepath.Join(l.dir, function), 0750)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create instance log directory: %s", err)
+		}
+		path = filepath.Join(l.dir, function, instance+".log")
+	}
+	buffer, err := NewLogBuffer(l.size, path, func(line LogLine) {
+		l.publish(function, instance, line)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	// drop the oldest logs of stopped instances beyond those retained
+	instances := l.functions[function]
+	stopped := 0
+	for _, entry := range instances {
+		if entry.buffer.Closed() {
+			stopped++
+		}
+	}
+	kept := instances[:0]
+	for _, entry := range instances {
+		if stopped > l.retain && entry.buffer.Closed() {
+			stopped--
+			entry.buffer.removeFile()
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	l.functions[function] = append(kept, &instanceLog{instance: instance, buffer: buffer})
+	return buffer, nil
+}
+
+// Sends a line to the followers of its instance. Lines are dropped for
+// followers too far behind rather than holding up the instance.
+func (l *InstanceLogs) publish(function string, instance string, line LogLine) {
+	l.followersLock.Lock()
+	defer l.followersLock.Unlock()
+	for follower := range l.followers {
+		if follower.function != function || (follower.instance != "" && follower.instance != instance) {
+			continue
+		}
+		select {
+		case follower.lines <- followedLine{instance: instance, line: line}:
+		default:
+		}
+	}
+}
+
+// Query returns the lines of the requested function's instances written since
+// the request's time, at most its tail of them, oldest first. Lines written
+// later are streamed until ctx is done when the request follows the logs.
+func (l *InstanceLogs) Query(ctx context.Context, request logs.Request) (<-chan logs.Message, error) {
+	// followers are registered before the history is read so no line is
+	// missed, lines that are in both are told apart by their number
+	var follower *logFollower
+	if request.Follow {
+		follower = &logFollower{function: request.Name, instance: request.Instance, lines: make(chan followedLine, logFollowerBacklog)}
+		l.followersLock.Lock()
+		l.followers[follower] = struct{}{}
+		l.followersLock.Unlock()
+	}
+
+	l.lock.Lock()
+	instances := append([]*instanceLog{}, l.functions[request.Name]...)
+	l.lock.Unlock()
+
+	var history []logs.Message
+	lastSeq := make(map[string]int64)
+	for _, entry := range instances {
+		if request.Instance != "" && entry.instance != request.Instance {
+			continue
+		}
+		lastSeq[entry.instance] = -1
+		for _, line := range entry.buffer.Lines() {
+			lastSeq[entry.instance] = line.Seq
+			if request.Since != nil && line.Time.Before(*request.Since) {
+				continue
+			}
+			history = append(history, logMessage(request, entry.instance, line))
+		}
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].Timestamp.Before(history[j].Timestamp)
+	})
+	if request.Tail > 0 && len(history) > request.Tail {
+		history = history[len(history)-request.Tail:]
+	}
+
+	messages := make(chan logs.Message)
+	go func() {
+		defer close(messages)
+		if follower != nil {
+			defer func() {
+				l.followersLock.Lock()
+				delete(l.followers, follower)
+				l.followersLock.Unlock()
+			}()
+		}
+		for _, message := range history {
+			select {
+			case messages <- message:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if follower == nil {
+			return
+		}
+		for {
+			select {
+			case followed := <-follower.lines:
+				if seq, ok := lastSeq[followed.instance]; ok && followed.line.Seq <= seq {
+					continue
+				}
+				select {
+				case messages <- logMessage(request, followed.instance, followed.line):
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return messages, nil
+}
+
+func logMessage(request logs.Request, instance string, line LogLine) logs.Message {
+	return logs.Message{
+		Name:      request.Name,
+		Namespace: request.Namespace,
+		Instance:  instance,
+		Timestamp: line.Time,
+		Text:      line.Text,
+	}
+}
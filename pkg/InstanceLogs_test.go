@@ -0,0 +1,200 @@
+package pkg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/openfaas/faas-provider/logs"
+)
+
+func lineTexts(lines []LogLine) []string {
+	texts := []string{}
+	for _, line := range lines {
+		texts = append(texts, line.Text)
+	}
+	return texts
+}
+
+func messageTexts(messages <-chan logs.Message) []string {
+	texts := []string{}
+	for message := range messages {
+		texts = append(texts, message.Instance+": "+message.Text)
+	}
+	return texts
+}
+
+func TestLogBufferLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instance.log")
+	buffer, err := NewLogBuffer(3, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.Write([]byte("booting\r\nlisten"))
+	buffer.Write([]byte("ing\none\ntwo\nunterminated"))
+
+	// only the latest lines are kept in memory
+	if got := strings.Join(lineTexts(buffer.Lines()), "|"); got != "listening|one|two" {
+		t.Errorf("unexpected lines %q", got)
+	}
+	buffer.Close()
+	if got := strings.Join(lineTexts(buffer.Lines()), "|"); got != "one|two|unterminated" {
+		t.Errorf("expected closing to end the last line, got %q", got)
+	}
+
+	// the file has every line
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n") {
+		_, text, _ := strings.Cut(line, " ")
+		texts = append(texts, text)
+	}
+	if got := strings.Join(texts, "|"); got != "booting|listening|one|two|unterminated" {
+		t.Errorf("unexpected file contents %q", contents)
+	}
+}
+
+func TestLogBufferSplitsLongLines(t *testing.T) {
+	buffer, _ := NewLogBuffer(10, "", nil)
+	buffer.Write([]byte(strings.Repeat("x", MaxLogLineBytes+1)))
+	lines := buffer.Lines()
+	if len(lines) != 1 || len(lines[0].Text) != MaxLogLineBytes {
+		t.Errorf("expected a line of %d bytes, got %d lines", MaxLogLineBytes, len(lines))
+	}
+}
+
+func TestLogBufferCapsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "instance.log")
+	buffer, err := NewLogBuffer(10, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer.fileLimit = 200
+	for i := 0; i < 20; i++ {
+		buffer.Write([]byte("chatty guest output\n"))
+	}
+	buffer.Close()
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(contents) > 200 {
+		t.Errorf("expected the file to be capped at 200 bytes, got %d", len(contents))
+	}
+	if !strings.HasSuffix(string(contents), " log file truncated at 200 bytes\n") {
+		t.Errorf("expected the file to end with the truncation, got %q", contents)
+	}
+	// the latest lines are still kept in memory
+	if got := len(buffer.Lines()); got != 10 {
+		t.Errorf("expected 10 lines in memory, got %d", got)
+	}
+}
+
+func TestInstanceLogsRemovesPrunedFiles(t *testing.T) {
+	dir := t.TempDir()
+	instanceLogs := NewInstanceLogs(dir, 10, 1)
+	a, _ := instanceLogs.Open("echo", "a")
+	b, _ := instanceLogs.Open("echo", "b")
+	a.Close()
+	b.Close()
+	instanceLogs.Open("echo", "c")
+
+	if _, err := os.Stat(filepath.Join(dir, "echo", "a.log")); !os.IsNotExist(err) {
+		t.Errorf("expected the pruned instance's log file to be removed, got %v", err)
+	}
+	for _, instance := range []string{"b", "c"} {
+		if _, err := os.Stat(filepath.Join(dir, "echo", instance+".log")); err != nil {
+			t.Errorf("expected the log file of %s to be kept: %s", instance, err)
+		}
+	}
+}
+
+func TestInstanceLogsQuery(t *testing.T) {
+	instanceLogs := NewInstanceLogs("", 10, 1)
+	a, _ := instanceLogs.Open("echo", "a")
+	a.Write([]byte("a1\n"))
+	since := time.Now()
+	b, _ := instanceLogs.Open("echo", "b")
+	b.Write([]byte("b1\n"))
+	a.Write([]byte("a2\n"))
+	other, _ := instanceLogs.Open("other", "c")
+	other.Write([]byte("c1\n"))
+
+	query := func(request logs.Request) string {
+		t.Helper()
+		request.Name = "echo"
+		messages, err := instanceLogs.Query(context.Background(), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(messageTexts(messages), "|")
+	}
+	if got := query(logs.Request{}); got != "a: a1|b: b1|a: a2" {
+		t.Errorf("unexpected logs %q", got)
+	}
+	if got := query(logs.Request{Tail: 2}); got != "b: b1|a: a2" {
+		t.Errorf("unexpected tail %q", got)
+	}
+	if got := query(logs.Request{Since: &since}); got != "b: b1|a: a2" {
+		t.Errorf("unexpected logs since %s: %q", since, got)
+	}
+	if got := query(logs.Request{Instance: "a"}); got != "a: a1|a: a2" {
+		t.Errorf("unexpected instance logs %q", got)
+	}
+
+	// logs of stopped instances are kept up to the retained number
+	a.Close()
+	b.Close()
+	instanceLogs.Open("echo", "d")
+	if got := query(logs.Request{}); got != "b: b1" {
+		t.Errorf("expected the oldest stopped instance to be dropped, got %q", got)
+	}
+}
+
+func TestInstanceLogsFollow(t *testing.T) {
+	instanceLogs := NewInstanceLogs("", 10, 1)
+	a, _ := instanceLogs.Open("echo", "a")
+	a.Write([]byte("before\n"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	messages, err := instanceLogs.Query(ctx, logs.Request{Name: "echo", Follow: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := func() string {
+		t.Helper()
+		select {
+		case message := <-messages:
+			return message.Instance + ": " + message.Text
+		case <-time.After(time.Second):
+			t.Fatal("no message followed")
+			return ""
+		}
+	}
+	if got := next(); got != "a: before" {
+		t.Errorf("expected the history first, got %q", got)
+	}
+
+	// lines of running and newly started instances are streamed
+	a.Write([]byte("after\n"))
+	if got := next(); got != "a: after" {
+		t.Errorf("unexpected message %q", got)
+	}
+	b, _ := instanceLogs.Open("echo", "b")
+	b.Write([]byte("started\n"))
+	if got := next(); got != "b: started" {
+		t.Errorf("unexpected message %q", got)
+	}
+
+	cancel()
+	for range messages {
+	}
+}
@@ -0,0 +1,332 @@
+package pkg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ManifestFileName = "manifest.json"
+	ManifestVersion  = "1"
+)
+
+// Runtime types a manifest can declare
+const (
+	RuntimeMicroVM   = "microvm"
+	RuntimeUnikernel = "unikernel"
+	RuntimeContainer = "container"
+	RuntimeProcess   = "process"
+)
+
+// VMMs a unikernel manifest can be run under
+const (
+	VmmQemu        = "qemu"
+	VmmFirecracker = "firecracker"
+)
+
+// Transports the hypervisor can reach a function's instances over
+const (
+	TransportTcp   = "tcp"
+	TransportVsock = "vsock"
+)
+
+// Manifest describes how to run a function. Artifact paths are relative to
+// the function directory unless absolute.
+type Manifest struct {
+	Version     string            `json:"version"`
+	Runtime     string            `json:"runtime"`
+	Kernel      string            `json:"kernel,omitempty"`
+	Rootfs      string            `json:"rootfs,omitempty"`
+	KernelArgs  string            `json:"kernelArgs,omitempty"`
+	Entrypoint  []string          `json:"entrypoint,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	Secrets     []string          `json:"secrets,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Readiness   Readiness         `json:"readiness"`
+	Exec        Exec              `json:"exec"`
+	Resources   Resources         `json:"resources"`
+	// Unikernel only setting. The kernel must have been built for the chosen VMM.
+	Vmm string `json:"vmm,omitempty"`
+	// MicroVM and unikernel setting. Instances reached over vsock get no tap
+	// device or IP, so the function has no network access.
+	Transport string `json:"transport,omitempty"`
+	// Container only settings. OciSpec is a partial OCI runtime spec merged
+	// over the one the hypervisor generates.
+	Mounts       []Mount    `json:"mounts,omitempty"`
+	Capabilities []string   `json:"capabilities,omitempty"`
+	OciSpec      string     `json:"ociSpec,omitempty"`
+	OciRuntime   OciRuntime `json:"ociRuntime"`
+}
+
+// OciRuntime is the OCI runtime that runs a container function, e.g. runsc,
+// runc, crun or kata-runtime. Args are global flags passed before the subcommand.
+type OciRuntime struct {
+	Binary string   `json:"binary"`
+	Args   []string `json:"args,omitempty"`
+}
+
+// Resources limits what a single instance of a function may use. Zero means unlimited.
+type Resources struct {
+	CpuMillicores int64 `json:"cpuMillicores"`
+	MemoryMiB     int64 `json:"memoryMiB"`
+}
+
+// Mount bind mounts Source from the host into a container at Destination
+type Mount struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	ReadOnly    bool   `json:"readOnly"`
+}
+
+func (m Mount) options() []string {
+	if m.ReadOnly {
+		return []string{"rbind", "ro"}
+	}
+	return []string{"rbind", "rw"}
+}
+
+// Readiness controls how long the hypervisor waits for an instance to call
+// /ready. A timeout of 0 waits forever.
+type Readiness struct {
+	TimeoutSeconds int `json:"timeoutSeconds"`
+}
+
+// Exec limits how long a single invocation may run before its instance is
+// killed. A timeout of 0 lets invocations run forever. The
+// ExecTimeoutAnnotation of the manifest or a deployment overrides it.
+type Exec struct {
+	TimeoutSeconds int `json:"timeoutSeconds"`
+}
+
+// ExecTimeoutAnnotation holds an exec timeout as a duration such as "30s" or
+// as a number of seconds
+const ExecTimeoutAnnotation = "com.openfaas.exec_timeout"
+
+// ParseExecTimeout parses the value of an ExecTimeoutAnnotation
+func ParseExecTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, secondsErr := strconv.Atoi(value)
+		if secondsErr != nil {
+			return 0, fmt.Errorf("invalid exec timeout %q", value)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	if timeout < 0 {
+		return 0, fmt.Errorf("exec timeout must not be negative")
+	}
+	return timeout, nil
+}
+
+// LoadManifest reads the manifest of the function in functionDir. Fields the
+// manifest leaves out are taken from defaults, and if there is no manifest at
+// all defaults is used as is. The result is validated and its artifact paths
+// resolved against functionDir.
+func LoadManifest(functionDir string, defaults Manifest) (*Manifest, error) {
+	// decoding writes into the slices and maps it finds, which must not be those of defaults
+	manifest := defaults.clone()
+	manifestPath := filepath.Join(functionDir, ManifestFileName)
+
+	manifestBytes, err := os.ReadFile(manifestPath)
+	if err == nil {
+		decoder := json.NewDecoder(bytes.NewReader(manifestBytes))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&manifest)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse %s: %s", manifestPath, err)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("Failed to read %s: %s", manifestPath, err)
+	}
+
+	if manifest.Labels == nil {
+		manifest.Labels = map[string]string{}
+	}
+	if manifest.Annotations == nil {
+		manifest.Annotations = map[string]string{}
+	}
+
+	if manifest.Kernel != "" && !filepath.IsAbs(manifest.Kernel) {
+		manifest.Kernel = filepath.Join(functionDir, manifest.Kernel)
+	}
+	if manifest.Rootfs != "" && !filepath.IsAbs(manifest.Rootfs) {
+		manifest.Rootfs = filepath.Join(functionDir, manifest.Rootfs)
+	}
+	// a process is started from the host, so a relative path names a binary in the function directory
+	if manifest.Runtime == RuntimeProcess && len(manifest.Entrypoint) > 0 && strings.Contains(manifest.Entrypoint[0], "/") && !filepath.IsAbs(manifest.Entrypoint[0]) {
+		manifest.Entrypoint = append([]string{filepath.Join(functionDir, manifest.Entrypoint[0])}, manifest.Entrypoint[1:]...)
+	}
+	if manifest.OciSpec != "" && !filepath.IsAbs(manifest.OciSpec) {
+		manifest.OciSpec = filepath.Join(functionDir, manifest.OciSpec)
+	}
+	for i, mount := range manifest.Mounts {
+		if !filepath.IsAbs(mount.Source) {
+			source, err := filepath.Abs(filepath.Join(functionDir, mount.Source))
+			if err != nil {
+				return nil, fmt.Errorf("Failed to resolve mount source %s: %s", mount.Source, err)
+			}
+			manifest.Mounts[i].Source = source
+		}
+	}
+
+	err = manifest.validate(defaults.Runtime)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid manifest %s: %s", manifestPath, err)
+	}
+	return &manifest, nil
+}
+
+// Returns a copy of m sharing none of its slices or maps
+func (m Manifest) clone() Manifest {
+	m.Entrypoint = cloneSlice(m.Entrypoint)
+	m.Secrets = cloneSlice(m.Secrets)
+	m.Mounts = cloneSlice(m.Mounts)
+	m.Capabilities = cloneSlice(m.Capabilities)
+	m.OciRuntime.Args = cloneSlice(m.OciRuntime.Args)
+	m.Env = cloneMap(m.Env)
+	m.Labels = cloneMap(m.Labels)
+	m.Annotations = cloneMap(m.Annotations)
+	return m
+}
+
+func cloneSlice[T any](s []T) []T {
+	if s == nil {
+		return nil
+	}
+	return append([]T{}, s...)
+}
+
+func cloneMap(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	clone := make(map[string]string, len(m))
+	for key, value := range m {
+		clone[key] = value
+	}
+	return clone
+}
+
+func (m *Manifest) validate(runtime string) error {
+	if m.Version != ManifestVersion {
+		return fmt.Errorf("unsupported version %q, expected %q", m.Version, ManifestVersion)
+	}
+
+	switch m.Runtime {
+	case RuntimeMicroVM, RuntimeUnikernel, RuntimeContainer, RuntimeProcess:
+	default:
+		return fmt.Errorf("unknown runtime %q", m.Runtime)
+	}
+	if m.Runtime != runtime {
+		return fmt.Errorf("runtime %q does not match the hypervisor runtime %q", m.Runtime, runtime)
+	}
+
+	if m.Runtime == RuntimeMicroVM || m.Runtime == RuntimeUnikernel {
+		if m.Kernel == "" {
+			return fmt.Errorf("runtime %q requires a kernel", m.Runtime)
+		}
+		if _, err := os.Stat(m.Kernel); err != nil {
+			return fmt.Errorf("kernel: %s", err)
+		}
+	}
+	if m.Runtime == RuntimeMicroVM || m.Runtime == RuntimeContainer {
+		if m.Rootfs == "" {
+			return fmt.Errorf("runtime %q requires a rootfs", m.Runtime)
+		}
+		if _, err := os.Stat(m.Rootfs); err != nil {
+			return fmt.Errorf("rootfs: %s", err)
+		}
+	}
+
+	if m.Runtime == RuntimeProcess {
+		if len(m.Entrypoint) == 0 {
+			return fmt.Errorf("runtime %q requires an entrypoint", m.Runtime)
+		}
+		if _, err := exec.LookPath(m.Entrypoint[0]); err != nil {
+			return fmt.Errorf("entrypoint: %s", err)
+		}
+	}
+
+	if m.Runtime == RuntimeContainer {
+		if len(m.Entrypoint) == 0 {
+			return fmt.Errorf("runtime %q requires an entrypoint", m.Runtime)
+		}
+		if _, err := exec.LookPath(m.OciRuntime.Binary); err != nil {
+			return fmt.Errorf("ociRuntime: %s", err)
+		}
+		if m.OciSpec != "" {
+			if _, err := os.Stat(m.OciSpec); err != nil {
+				return fmt.Errorf("ociSpec: %s", err)
+			}
+		}
+		for _, mount := range m.Mounts {
+			if !filepath.IsAbs(mount.Destination) {
+				return fmt.Errorf("mount destination %q must be an absolute path", mount.Destination)
+			}
+			if _, err := os.Stat(mount.Source); err != nil {
+				return fmt.Errorf("mount source: %s", err)
+			}
+		}
+	} else if len(m.Mounts) > 0 || len(m.Capabilities) > 0 || m.OciSpec != "" || m.OciRuntime.Binary != "" {
+		return fmt.Errorf("mounts, capabilities, ociSpec and ociRuntime are only supported by the %q runtime", RuntimeContainer)
+	}
+
+	if m.Runtime == RuntimeUnikernel {
+		switch m.Vmm {
+		case VmmQemu, VmmFirecracker:
+		default:
+			return fmt.Errorf("unknown vmm %q", m.Vmm)
+		}
+	} else if m.Vmm != "" {
+		return fmt.Errorf("vmm is only supported by the %q runtime", RuntimeUnikernel)
+	}
+
+	switch m.Transport {
+	case "", TransportTcp:
+	case TransportVsock:
+		if m.Runtime != RuntimeMicroVM && m.Runtime != RuntimeUnikernel {
+			return fmt.Errorf("transport %q is only supported by the %q and %q runtimes", m.Transport, RuntimeMicroVM, RuntimeUnikernel)
+		}
+	default:
+		return fmt.Errorf("unknown transport %q", m.Transport)
+	}
+
+	if m.Resources.CpuMillicores < 0 || m.Resources.MemoryMiB < 0 {
+		return fmt.Errorf("resources must not be negative")
+	}
+
+	for name := range m.Env {
+		if !ValidEnvName(name) {
+			return fmt.Errorf("invalid environment variable name %q", name)
+		}
+	}
+
+	for _, secret := range m.Secrets {
+		if !ValidSecretName(secret) {
+			return fmt.Errorf("invalid secret name %q", secret)
+		}
+	}
+
+	if m.Readiness.TimeoutSeconds < 0 {
+		return fmt.Errorf("readiness timeout must not be negative")
+	}
+	if m.Exec.TimeoutSeconds < 0 {
+		return fmt.Errorf("exec timeout must not be negative")
+	}
+	if value, ok := m.Annotations[ExecTimeoutAnnotation]; ok {
+		if _, err := ParseExecTimeout(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Creates a function directory holding manifest, or no manifest when it is
+// empty, along with a kernel and a rootfs
+func functionDir(t *testing.T, manifest string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for _, artifact := range []string{"vmlinux", "rootfs.ext4"} {
+		if err := os.WriteFile(filepath.Join(dir, artifact), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if manifest != "" {
+		if err := os.WriteFile(filepath.Join(dir, ManifestFileName), []byte(manifest), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func microVMDefaults() Manifest {
+	return Manifest{Version: ManifestVersion, Runtime: RuntimeMicroVM, Kernel: "vmlinux", Rootfs: "rootfs.ext4"}
+}
+
+func TestLoadManifestDefaults(t *testing.T) {
+	dir := functionDir(t, "")
+	manifest, err := LoadManifest(dir, microVMDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Kernel != filepath.Join(dir, "vmlinux") || manifest.Rootfs != filepath.Join(dir, "rootfs.ext4") {
+		t.Errorf("expected artifacts resolved against %s, got %s and %s", dir, manifest.Kernel, manifest.Rootfs)
+	}
+	if manifest.Labels == nil || manifest.Annotations == nil {
+		t.Error("expected labels and annotations to be initialised")
+	}
+}
+
+func TestLoadManifestOverridesDefaults(t *testing.T) {
+	dir := functionDir(t, `{"version": "1", "runtime": "microvm", "env": {"GREETING": "hello"}, "readiness": {"timeoutSeconds": 5}}`)
+	manifest, err := LoadManifest(dir, microVMDefaults())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Env["GREETING"] != "hello" || manifest.Readiness.TimeoutSeconds != 5 {
+		t.Errorf("expected the manifest's env and readiness, got %v and %d", manifest.Env, manifest.Readiness.TimeoutSeconds)
+	}
+	// left out of the manifest
+	if manifest.Kernel != filepath.Join(dir, "vmlinux") {
+		t.Errorf("expected the default kernel, got %s", manifest.Kernel)
+	}
+}
+
+func TestLoadManifestKeepsDefaultsIntact(t *testing.T) {
+	defaults := Manifest{Version: ManifestVersion, Runtime: RuntimeContainer, Rootfs: "rootfs.ext4", Entrypoint: []string{"/server"}, Annotations: map[string]string{"a": "1"}}
+	defaults.OciRuntime = OciRuntime{Binary: "sh", Args: []string{"--debug"}}
+	custom := functionDir(t, `{"version": "1", "runtime": "container", "entrypoint": ["/other"], "annotations": {"a": "2"}, "ociRuntime": {"binary": "sh", "args": ["--trace"]}}`)
+	if _, err := LoadManifest(custom, defaults); err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := LoadManifest(functionDir(t, `{"version": "1", "runtime": "container"}`), defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Entrypoint) != 1 || manifest.Entrypoint[0] != "/server" || manifest.Annotations["a"] != "1" || manifest.OciRuntime.Args[0] != "--debug" {
+		t.Errorf("expected the defaults, got entrypoint %v, annotations %v and runtime args %v", manifest.Entrypoint, manifest.Annotations, manifest.OciRuntime.Args)
+	}
+}
+
+func TestLoadManifestErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest string
+		expected string
+	}{
+		{"unknown field", `{"version": "1", "runtime": "microvm", "kernal": "vmlinux"}`, `unknown field "kernal"`},
+		{"malformed", `{"version": "1",`, "Failed to parse"},
+		{"unsupported version", `{"version": "2", "runtime": "microvm"}`, `unsupported version "2"`},
+		{"unknown runtime", `{"version": "1", "runtime": "vm"}`, `unknown runtime "vm"`},
+		{"runtime mismatch", `{"version": "1", "runtime": "container", "rootfs": "rootfs.ext4", "entrypoint": ["/server"]}`, `runtime "container" does not match the hypervisor runtime "microvm"`},
+		{"missing kernel", `{"version": "1", "runtime": "microvm", "kernel": "bzImage"}`, "kernel: stat"},
+		{"missing rootfs", `{"version": "1", "runtime": "microvm", "rootfs": "missing.ext4"}`, "rootfs: stat"},
+		{"vmm on a microvm", `{"version": "1", "runtime": "microvm", "vmm": "qemu"}`, "vmm is only supported"},
+		{"invalid env name", `{"version": "1", "runtime": "microvm", "env": {"A B": "1"}}`, `invalid environment variable name "A B"`},
+		{"invalid secret name", `{"version": "1", "runtime": "microvm", "secrets": ["../key"]}`, `invalid secret name "../key"`},
+		{"negative readiness timeout", `{"version": "1", "runtime": "microvm", "readiness": {"timeoutSeconds": -1}}`, "readiness timeout must not be negative"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := functionDir(t, test.manifest)
+			_, err := LoadManifest(dir, microVMDefaults())
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.Contains(err.Error(), test.expected) {
+				t.Errorf("expected an error containing %q, got %q", test.expected, err)
+			}
+			if !strings.Contains(err.Error(), filepath.Join(dir, ManifestFileName)) {
+				t.Errorf("expected the error to name the manifest, got %q", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package pkg
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// MemoryUsage is the memory used by a process tree. The working set is the
+// memory referenced since the previous sample, measured like wss.pl does
+// through /proc/<pid>/clear_refs.
+type MemoryUsage struct {
+	RssKiB int64 `json:"rssKiB"`
+	PssKiB int64 `json:"pssKiB"`
+	WssKiB int64 `json:"wssKiB"`
+}
+
+func (u MemoryUsage) Add(other MemoryUsage) MemoryUsage {
+	return MemoryUsage{RssKiB: u.RssKiB + other.RssKiB, PssKiB: u.PssKiB + other.PssKiB, WssKiB: u.WssKiB + other.WssKiB}
+}
+
+// MemoryAggregate sums the memory usage of several instances
+type MemoryAggregate struct {
+	Instances int         `json:"instances"`
+	Total     MemoryUsage `json:"total"`
+	Average   MemoryUsage `json:"average"`
+}
+
+func (a *MemoryAggregate) Add(usage MemoryUsage) {
+	a.Instances++
+	a.Total = a.Total.Add(usage)
+	count := int64(a.Instances)
+	a.Average = MemoryUsage{RssKiB: a.Total.RssKiB / count, PssKiB: a.Total.PssKiB / count, WssKiB: a.Total.WssKiB / count}
+}
+
+// InstanceMemory is the latest memory usage sample of an instance
+type InstanceMemory struct {
+	Address    string `json:"address"`
+	Function   string `json:"function"`
+	InstanceId string `json:"instanceId"`
+	MemoryUsage
+}
+
+// MemoryStats is the memory usage of every instance, aggregated per function
+// and for the whole runtime
+type MemoryStats struct {
+	Runtime   string                     `json:"runtime"`
+	Total     MemoryAggregate            `json:"total"`
+	Functions map[string]MemoryAggregate `json:"functions"`
+	Instances []InstanceMemory           `json:"instances"`
+}
+
+func NewMemoryStats(runtime string, instances []InstanceMemory) MemoryStats {
+	stats := MemoryStats{Runtime: runtime, Functions: make(map[string]MemoryAggregate), Instances: instances}
+	for _, instance := range instances {
+		stats.Total.Add(instance.MemoryUsage)
+		function := stats.Functions[instance.Function]
+		function.Add(instance.MemoryUsage)
+		stats.Functions[instance.Function] = function
+	}
+	return stats
+}
+
+// ProcessChildren maps the pid of every process to the pids of its children
+func ProcessChildren() (map[int][]int, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list processes: %s", err)
+	}
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		child, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			// the process exited while listing
+			continue
+		}
+		// the command name can contain spaces and parentheses, the parent pid
+		// is the second field after it
+		fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		parent, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		children[parent] = append(children[parent], child)
+	}
+	return children, nil
+}
+
+// ProcessTree returns pid and all of its descendants, e.g. the sandbox and
+// gofer processes started by runsc
+func ProcessTree(children map[int][]int, pid int) []int {
+	tree := []int{pid}
+	for i := 0; i < len(tree); i++ {
+		tree = append(tree, children[tree[i]]...)
+	}
+	return tree
+}
+
+// SampleMemoryUsage sums the memory usage of pids and starts a new working set
+// measurement for the next sample
+func SampleMemoryUsage(pids []int) (MemoryUsage, error) {
+	var usage MemoryUsage
+	for _, pid := range pids {
+		processUsage, err := readSmapsRollup(pid)
+		if err != nil {
+			return usage, err
+		}
+		usage = usage.Add(processUsage)
+
+		// clears the referenced bit of every page so the next sample only
+		// counts pages referenced after this one
+		err = os.WriteFile(filepath.Join("/proc", strconv.Itoa(pid), "clear_refs"), []byte("1"), 0)
+		if err != nil {
+			return usage, fmt.Errorf("Failed to clear referenced pages of %d: %s", pid, err)
+		}
+	}
+	return usage, nil
+}
+
+func readSmapsRollup(pid int) (MemoryUsage, error) {
+	var usage MemoryUsage
+	file, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "smaps_rollup"))
+	if err != nil {
+		return usage, fmt.Errorf("Failed to read memory usage of %d: %s", pid, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "Rss:":
+			usage.RssKiB = value
+		case "Pss:":
+			usage.PssKiB = value
+		case "Referenced:":
+			usage.WssKiB = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return usage, fmt.Errorf("Failed to read memory usage of %d: %s", pid, err)
+	}
+	return usage, nil
+}
@@ -0,0 +1,34 @@
+package pkg
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Link-local address guests use to reach the Firecracker metadata service
+const MmdsAddress = "169.254.169.254"
+
+// MmdsDocument is the metadata published to each microVM. Guests read it from
+// http://169.254.169.254/openfaas/...
+type MmdsDocument struct {
+	OpenFaaS MmdsInstanceConfig `json:"openfaas"`
+}
+
+type MmdsInstanceConfig struct {
+	FunctionName   string            `json:"functionName"`
+	InstanceId     string            `json:"instanceId"`
+	HypervisorIp   string            `json:"hypervisorIp"`
+	CallbackUrl    string            `json:"callbackUrl"`
+	ReadinessToken string            `json:"readinessToken"`
+	Env            map[string]string `json:"env"`
+}
+
+// RandomToken returns a random hex token suitable for authenticating instances
+func RandomToken() string {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(token)
+}
@@ -1,12 +1,25 @@
 package pkg
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
+
+	"github.com/containernetworking/cni/libcni"
+	current "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// CNI network and plugins used to connect containers, relative to the working directory
+const (
+	cniConfigPath = "./containers/cni_config.conflist"
+	cniPluginDir  = "./containers"
 )
 
 func AddBridge(name string, ip string, mask string) error {
@@ -81,57 +94,184 @@ func RandomMacAddress() string {
 	return strings.TrimRight(macAddress, ":")
 }
 
-func BridgeContainer(containerId string) (string, error) {
-	out, err := exec.Command(`ip`, `netns`, `add`, containerId).Output()
+// Loads the CNI network used for containers. Either a single plugin config
+// (.conf/.json) or a plugin chain (.conflist) is accepted.
+func loadCniNetwork(configPath string) (*libcni.NetworkConfigList, error) {
+	if strings.HasSuffix(configPath, ".conflist") {
+		networkList, err := libcni.ConfListFromFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load cni config list: %s\n", err)
+		}
+		return networkList, nil
+	}
+
+	network, err := libcni.ConfFromFile(configPath)
 	if err != nil {
-		return "", fmt.Errorf("Error creating network namespace: %s, %s\n", err.(*exec.ExitError).Stderr, out)
+		return nil, fmt.Errorf("Failed to load cni config: %s\n", err)
 	}
+	networkList, err := libcni.ConfListFromConf(network)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to convert cni config to a list: %s\n", err)
+	}
+	return networkList, nil
+}
 
-	bridgeCmd := exec.Command(`./containers/bridge`)
+// Returns the CNI runtime, network and runtime config for a container
+func cniContainerConfig(containerId string) (*libcni.CNIConfig, *libcni.NetworkConfigList, *libcni.RuntimeConf, error) {
 	wd, err := os.Getwd()
 	if err != nil {
-		return "", fmt.Errorf("Failed to get current working directory: %s\n", err)
+		return nil, nil, nil, fmt.Errorf("Failed to get current working directory: %s\n", err)
 	}
-	bridgeCmd.Env = []string{"CNI_COMMAND=ADD", "CNI_CONTAINERID=" + containerId, "CNI_NETNS=/run/netns/" + containerId, "CNI_IFNAME=eth0", "CNI_PATH=" + wd + "/containers"}
-	cniConfig, err := os.Open("./containers/cni_config.json")
+	networkList, err := loadCniNetwork(cniConfigPath)
 	if err != nil {
-		return "", fmt.Errorf("Failed to open cni config file: %s\n", err)
+		return nil, nil, nil, err
 	}
-	bridgeCmd.Stdin = cniConfig
 
-	out, err = bridgeCmd.Output()
+	cniConfig := libcni.NewCNIConfig([]string{filepath.Join(wd, cniPluginDir)}, nil)
+	runtimeConf := &libcni.RuntimeConf{
+		ContainerID: containerId,
+		NetNS:       "/run/netns/" + containerId,
+		IfName:      "eth0",
+	}
+	return cniConfig, networkList, runtimeConf, nil
+}
+
+// BridgeContainer creates the network namespace of a container and connects
+// it to the bridge through CNI. Nothing is left behind when it fails.
+func BridgeContainer(containerId string) (string, error) {
+	out, err := exec.Command(`ip`, `netns`, `add`, containerId).Output()
 	if err != nil {
-		return "", fmt.Errorf("Failed connect container to bridge: %s, %s", err.(*exec.ExitError).Stderr, out)
+		return "", fmt.Errorf("Error creating network namespace: %s, %s\n", commandStderr(err), out)
 	}
 
-	var result map[string]map[string]string
-	json.Unmarshal(out, &result)
-	ip := strings.Split(result["ip4"]["ip"], "/")[0]
+	cniConfig, networkList, runtimeConf, err := cniContainerConfig(containerId)
+	if err != nil {
+		DeleteNetns(containerId)
+		return "", err
+	}
+	ip, err := addContainerNetwork(cniConfig, networkList, runtimeConf)
+	if err != nil {
+		// releases whatever the plugins set up before failing, such as an IP
+		cniConfig.DelNetworkList(context.Background(), networkList, runtimeConf)
+		DeleteNetns(containerId)
+		return "", err
+	}
 	return ip, nil
 }
 
-func UnbridgeContainer(containerId string) error {
-	unbridgeCmd := exec.Command(`./containers/bridge`)
-	wd, err := os.Getwd()
+func addContainerNetwork(cniConfig *libcni.CNIConfig, networkList *libcni.NetworkConfigList, runtimeConf *libcni.RuntimeConf) (string, error) {
+	result, err := cniConfig.AddNetworkList(context.Background(), networkList, runtimeConf)
 	if err != nil {
-		return fmt.Errorf("Failed to get current working directory: %s\n", err)
+		return "", fmt.Errorf("Failed connect container to bridge: %s", err)
 	}
-	unbridgeCmd.Env = []string{"CNI_COMMAND=DEL", "CNI_CONTAINERID=" + containerId, "CNI_NETNS=/run/netns/" + containerId, "CNI_IFNAME=eth0", "CNI_PATH=" + wd + "/containers"}
-	cniConfig, err := os.Open("./containers/cni_config.json")
+
+	// convert results of older cni versions to the current format
+	currentResult, err := current.NewResultFromResult(result)
 	if err != nil {
-		return fmt.Errorf("Failed to open cni config file: %s\n", err)
+		return "", fmt.Errorf("Failed to parse cni result: %s", err)
+	}
+	if len(currentResult.IPs) == 0 {
+		return "", fmt.Errorf("No ip assigned to container %s", runtimeConf.ContainerID)
 	}
-	unbridgeCmd.Stdin = cniConfig
+	return currentResult.IPs[0].Address.IP.String(), nil
+}
 
-	out, err := unbridgeCmd.Output()
+// CheckContainer asks the CNI plugins to verify that a container's networking is still as configured
+func CheckContainer(containerId string) error {
+	cniConfig, networkList, runtimeConf, err := cniContainerConfig(containerId)
+	if err != nil {
+		return err
+	}
+	err = cniConfig.CheckNetworkList(context.Background(), networkList, runtimeConf)
 	if err != nil {
-		return fmt.Errorf("Failed deconnect container from bridge: %s, %s", err.(*exec.ExitError).Stderr, out)
+		return fmt.Errorf("Container %s failed network check: %s", containerId, err)
 	}
+	return nil
+}
 
-	out, err = exec.Command(`ip`, `netns`, `del`, containerId).Output()
+func UnbridgeContainer(containerId string) error {
+	cniConfig, networkList, runtimeConf, err := cniContainerConfig(containerId)
+	if err != nil {
+		return err
+	}
+	err = cniConfig.DelNetworkList(context.Background(), networkList, runtimeConf)
+	if err != nil {
+		return fmt.Errorf("Failed deconnect container from bridge: %s", err)
+	}
+
+	out, err := exec.Command(`ip`, `netns`, `del`, containerId).Output()
 	if err != nil {
 		return fmt.Errorf("Error deleting network namespace: %s, %s\n", err.(*exec.ExitError).Stderr, out)
 	}
 
 	return nil
 }
+
+// AddNetnsTap creates a network namespace containing a tap device owned by
+// uid and gid. The tap is bridged to hostBridgeName through a veth pair, so a
+// VM using it sits on the same network as VMs using taps made by AddTap.
+func AddNetnsTap(netnsName string, vethName string, tapName string, hostBridgeName string, uid int, gid int) error {
+	out, err := exec.Command(`ip`, `netns`, `add`, netnsName).Output()
+	if err != nil {
+		return fmt.Errorf("Error creating network namespace: %s, %s\n", err.(*exec.ExitError).Stderr, out)
+	}
+
+	// connect the namespace to the host bridge
+	out, err = exec.Command(`ip`, `link`, `add`, vethName, `type`, `veth`, `peer`, `name`, `eth0`, `netns`, netnsName).Output()
+	if err != nil {
+		return fmt.Errorf("Error creating veth pair: %s, %s\n", err.(*exec.ExitError).Stderr, out)
+	}
+	out, err = exec.Command(`ip`, `link`, `set`, `dev`, vethName, `master`, hostBridgeName, `up`).Output()
+	if err != nil {
+		return fmt.Errorf("Error attaching veth to bridge: %s, %s\n", err.(*exec.ExitError).Stderr, out)
+	}
+
+	// bridge the tap to the veth inside the namespace
+	commands := [][]string{
+		{`ip`, `link`, `add`, `br0`, `type`, `bridge`},
+		{`ip`, `link`, `set`, `dev`, `eth0`, `master`, `br0`},
+		{`ip`, `tuntap`, `add`, `dev`, tapName, `mode`, `tap`, `user`, strconv.Itoa(uid), `group`, strconv.Itoa(gid)},
+		{`ip`, `link`, `set`, `dev`, tapName, `master`, `br0`},
+		{`ip`, `link`, `set`, `dev`, `eth0`, `up`},
+		{`ip`, `link`, `set`, `dev`, tapName, `up`},
+		{`ip`, `link`, `set`, `dev`, `br0`, `up`},
+	}
+	for _, command := range commands {
+		out, err = exec.Command(`ip`, append([]string{`netns`, `exec`, netnsName}, command...)...).Output()
+		if err != nil {
+			return fmt.Errorf("Error configuring network namespace %s: %s, %s\n", netnsName, err.(*exec.ExitError).Stderr, out)
+		}
+	}
+	return nil
+}
+
+// DeleteNetns deletes a network namespace made by AddNetnsTap. Deleting the
+// namespace also removes the tap and both ends of the veth pair.
+func DeleteNetns(netnsName string) error {
+	out, err := exec.Command(`ip`, `netns`, `del`, netnsName).Output()
+	if err != nil {
+		return fmt.Errorf("Error deleting network namespace: %s, %s\n", commandStderr(err), out)
+	}
+	return nil
+}
+
+// Returns the stderr of a command that failed, or the error itself when the
+// command couldn't be run at all, e.g. because it isn't installed
+func commandStderr(err error) string {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return string(exitErr.Stderr)
+	}
+	return err.Error()
+}
+
+// FreeLoopbackPort asks the kernel for a TCP port that is currently unused on
+// the loopback interface
+func FreeLoopbackPort() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", fmt.Errorf("Failed to find a free loopback port: %s", err)
+	}
+	defer listener.Close()
+	return strconv.Itoa(listener.Addr().(*net.TCPAddr).Port), nil
+}
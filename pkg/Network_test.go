@@ -0,0 +1,19 @@
+package pkg
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestCommandStderr(t *testing.T) {
+	_, err := exec.Command("sh", "-c", "echo failed >&2; exit 1").Output()
+	if got := commandStderr(err); got != "failed\n" {
+		t.Errorf("expected the command's stderr, got %q", got)
+	}
+	// a missing command has no stderr, which must not panic
+	_, err = exec.Command("openfaas-hypervisor-missing-command").Output()
+	if got := commandStderr(err); !strings.Contains(got, "not found") {
+		t.Errorf("expected the error of the missing command, got %q", got)
+	}
+}
@@ -0,0 +1,201 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const ociCpuPeriod = 100000
+
+var defaultCapabilities = []string{"CAP_AUDIT_WRITE", "CAP_KILL", "CAP_NET_BIND_SERVICE"}
+
+// GenerateOciSpec builds the OCI runtime spec for an instance of the function
+// described by manifest. The rootfs is expected at "rootfs" inside the bundle
+// and netnsPath is the network namespace the container joins.
+func GenerateOciSpec(functionName string, manifest *Manifest, env []string, netnsPath string) *specs.Spec {
+	capabilities := defaultCapabilities
+	if len(manifest.Capabilities) > 0 {
+		capabilities = manifest.Capabilities
+	}
+
+	spec := &specs.Spec{
+		Version: specs.Version,
+		Process: &specs.Process{
+			User: specs.User{UID: 0, GID: 0},
+			Args: manifest.Entrypoint,
+			Env:  append([]string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"}, env...),
+			Cwd:  "/",
+			Capabilities: &specs.LinuxCapabilities{
+				Bounding:    capabilities,
+				Effective:   capabilities,
+				Inheritable: capabilities,
+				Permitted:   capabilities,
+				Ambient:     capabilities,
+			},
+			Rlimits:         []specs.POSIXRlimit{{Type: "RLIMIT_NOFILE", Hard: 1024, Soft: 1024}},
+			NoNewPrivileges: true,
+		},
+		Root:     &specs.Root{Path: "rootfs", Readonly: true},
+		Hostname: functionName,
+		Mounts: []specs.Mount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620", "gid=5"}},
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+			{Destination: "/dev/mqueue", Type: "mqueue", Source: "mqueue", Options: []string{"nosuid", "noexec", "nodev"}},
+			{Destination: "/sys", Type: "sysfs", Source: "sysfs", Options: []string{"nosuid", "noexec", "nodev", "ro"}},
+			{Destination: "/sys/fs/cgroup", Type: "cgroup", Source: "cgroup", Options: []string{"nosuid", "noexec", "nodev", "relatime", "ro"}},
+		},
+		Linux: &specs.Linux{
+			Resources: &specs.LinuxResources{
+				Devices: []specs.LinuxDeviceCgroup{{Allow: false, Access: "rwm"}},
+			},
+			Namespaces: []specs.LinuxNamespace{
+				{Type: specs.PIDNamespace},
+				{Type: specs.NetworkNamespace, Path: netnsPath},
+				{Type: specs.IPCNamespace},
+				{Type: specs.UTSNamespace},
+				{Type: specs.MountNamespace},
+				{Type: specs.CgroupNamespace},
+			},
+			MaskedPaths: []string{
+				"/proc/acpi", "/proc/asound", "/proc/kcore", "/proc/keys", "/proc/latency_stats",
+				"/proc/timer_list", "/proc/timer_stats", "/proc/sched_debug", "/sys/firmware", "/proc/scsi",
+			},
+			ReadonlyPaths: []string{"/proc/bus", "/proc/fs", "/proc/irq", "/proc/sys", "/proc/sysrq-trigger"},
+		},
+	}
+
+	for _, mount := range manifest.Mounts {
+		spec.Mounts = append(spec.Mounts, specs.Mount{Destination: mount.Destination, Type: "bind", Source: mount.Source, Options: mount.options()})
+	}
+
+	if manifest.Resources.CpuMillicores > 0 {
+		quota := manifest.Resources.CpuMillicores * ociCpuPeriod / 1000
+		period := uint64(ociCpuPeriod)
+		spec.Linux.Resources.CPU = &specs.LinuxCPU{Quota: &quota, Period: &period}
+	}
+	if manifest.Resources.MemoryMiB > 0 {
+		limit := manifest.Resources.MemoryMiB * 1024 * 1024
+		spec.Linux.Resources.Memory = &specs.LinuxMemory{Limit: &limit}
+	}
+
+	return spec
+}
+
+// MergeOciSpec overlays the partial spec in partialPath onto spec. Objects are
+// merged key by key, while arrays and scalar values in the partial spec
+// replace those in spec.
+func MergeOciSpec(spec *specs.Spec, partialPath string) (*specs.Spec, error) {
+	partialBytes, err := os.ReadFile(partialPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read partial OCI spec: %s", err)
+	}
+	var partial map[string]any
+	err = json.Unmarshal(partialBytes, &partial)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse partial OCI spec %s: %s", partialPath, err)
+	}
+
+	specBytes, err := json.Marshal(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal OCI spec: %s", err)
+	}
+	var base map[string]any
+	err = json.Unmarshal(specBytes, &base)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal OCI spec: %s", err)
+	}
+
+	mergedBytes, err := json.Marshal(mergeJson(base, partial))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal merged OCI spec: %s", err)
+	}
+	merged := &specs.Spec{}
+	err = json.Unmarshal(mergedBytes, merged)
+	if err != nil {
+		return nil, fmt.Errorf("Partial OCI spec %s does not produce a valid spec: %s", partialPath, err)
+	}
+	return merged, nil
+}
+
+func mergeJson(base map[string]any, overlay map[string]any) map[string]any {
+	for key, value := range overlay {
+		overlayObject, overlayIsObject := value.(map[string]any)
+		baseObject, baseIsObject := base[key].(map[string]any)
+		if overlayIsObject && baseIsObject {
+			base[key] = mergeJson(baseObject, overlayObject)
+		} else {
+			base[key] = value
+		}
+	}
+	return base
+}
+
+// ValidateOciSpec checks that spec can be run by the hypervisor
+func ValidateOciSpec(spec *specs.Spec) error {
+	if spec.Version == "" {
+		return fmt.Errorf("ociVersion must be set")
+	}
+	if spec.Process == nil || len(spec.Process.Args) == 0 {
+		return fmt.Errorf("process.args must not be empty")
+	}
+	if !filepath.IsAbs(spec.Process.Cwd) {
+		return fmt.Errorf("process.cwd must be an absolute path")
+	}
+	for _, variable := range spec.Process.Env {
+		if !strings.Contains(variable, "=") {
+			return fmt.Errorf("process.env entry %q is not of the form NAME=value", variable)
+		}
+	}
+	if spec.Root == nil || spec.Root.Path == "" {
+		return fmt.Errorf("root.path must be set")
+	}
+	for _, mount := range spec.Mounts {
+		if !filepath.IsAbs(mount.Destination) {
+			return fmt.Errorf("mount destination %q must be an absolute path", mount.Destination)
+		}
+	}
+
+	if spec.Linux == nil {
+		return fmt.Errorf("linux section is required")
+	}
+	hasNetwork := false
+	seen := make(map[specs.LinuxNamespaceType]bool)
+	for _, namespace := range spec.Linux.Namespaces {
+		switch namespace.Type {
+		case specs.PIDNamespace, specs.NetworkNamespace, specs.MountNamespace, specs.IPCNamespace,
+			specs.UTSNamespace, specs.UserNamespace, specs.CgroupNamespace:
+		default:
+			return fmt.Errorf("unknown namespace type %q", namespace.Type)
+		}
+		if seen[namespace.Type] {
+			return fmt.Errorf("namespace %q is declared more than once", namespace.Type)
+		}
+		seen[namespace.Type] = true
+		hasNetwork = hasNetwork || (namespace.Type == specs.NetworkNamespace && namespace.Path != "")
+	}
+	if !hasNetwork {
+		return fmt.Errorf("the container must join the network namespace prepared by the hypervisor")
+	}
+	return nil
+}
+
+// WriteOciSpec writes spec as the config.json of the bundle in bundleDir
+func WriteOciSpec(spec *specs.Spec, bundleDir string) error {
+	specBytes, err := json.MarshalIndent(spec, "", "\t")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal OCI spec: %s", err)
+	}
+	// the spec can contain secrets
+	err = os.WriteFile(filepath.Join(bundleDir, "config.json"), specBytes, 0600)
+	if err != nil {
+		return fmt.Errorf("Error writing container config file: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package pkg
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Headers that only apply to a single connection and must not be forwarded
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// CopyHeaders adds the end-to-end headers of src to dst, leaving out hop-by-hop
+// headers and the headers named by src's Connection header
+func CopyHeaders(dst http.Header, src http.Header) {
+	skip := make(map[string]bool)
+	for _, name := range hopByHopHeaders {
+		skip[name] = true
+	}
+	for _, value := range src.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			skip[http.CanonicalHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+
+	for name, values := range src {
+		if skip[name] {
+			continue
+		}
+		for _, value := range values {
+			dst.Add(name, value)
+		}
+	}
+}
+
+// SetForwardedHeaders sets the X-Forwarded-* headers of a request proxied on
+// behalf of in, appending to the X-Forwarded-For chain of earlier proxies
+func SetForwardedHeaders(out *http.Request, in *http.Request) {
+	if clientIp, _, err := net.SplitHostPort(in.RemoteAddr); err == nil {
+		if prior := in.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			clientIp = strings.Join(prior, ", ") + ", " + clientIp
+		}
+		out.Header.Set("X-Forwarded-For", clientIp)
+	}
+	if in.Header.Get("X-Forwarded-Host") == "" {
+		out.Header.Set("X-Forwarded-Host", in.Host)
+	}
+	if in.Header.Get("X-Forwarded-Proto") == "" {
+		if in.TLS != nil {
+			out.Header.Set("X-Forwarded-Proto", "https")
+		} else {
+			out.Header.Set("X-Forwarded-Proto", "http")
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// QmpClient is a minimal client for the QEMU Machine Protocol
+type QmpClient struct {
+	conn    net.Conn
+	decoder *json.Decoder
+}
+
+type qmpResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class       string `json:"class"`
+		Description string `json:"desc"`
+	} `json:"error"`
+	Event string `json:"event"`
+}
+
+// QmpStatus is the result of query-status
+type QmpStatus struct {
+	Running bool   `json:"running"`
+	Status  string `json:"status"`
+}
+
+// DialQmp connects to the QMP socket of a QEMU instance, waiting up to
+// timeout for QEMU to create it, and negotiates capabilities.
+func DialQmp(socketPath string, timeout time.Duration) (*QmpClient, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if _, err := os.Stat(socketPath); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("QMP socket %s did not appear within %s", socketPath, timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	conn, err := net.DialTimeout("unix", socketPath, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to QMP socket %s: %s", socketPath, err)
+	}
+	conn.SetDeadline(deadline)
+	client := &QmpClient{conn: conn, decoder: json.NewDecoder(conn)}
+
+	// QEMU greets every new client before accepting commands
+	var greeting map[string]any
+	err = client.decoder.Decode(&greeting)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to read QMP greeting: %s", err)
+	}
+	_, err = client.Execute("qmp_capabilities", nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return client, nil
+}
+
+// Execute runs a QMP command and returns its result, skipping any
+// asynchronous events that arrive first
+func (c *QmpClient) Execute(command string, arguments any) (json.RawMessage, error) {
+	request := map[string]any{"execute": command}
+	if arguments != nil {
+		request["arguments"] = arguments
+	}
+	requestBytes, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal QMP command %s: %s", command, err)
+	}
+	_, err = c.conn.Write(requestBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to send QMP command %s: %s", command, err)
+	}
+
+	for {
+		var response qmpResponse
+		err = c.decoder.Decode(&response)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read QMP response to %s: %s", command, err)
+		}
+		if response.Event != "" {
+			continue
+		}
+		if response.Error != nil {
+			return nil, fmt.Errorf("QMP command %s failed: %s: %s", command, response.Error.Class, response.Error.Description)
+		}
+		return response.Return, nil
+	}
+}
+
+func (c *QmpClient) QueryStatus() (QmpStatus, error) {
+	var status QmpStatus
+	result, err := c.Execute("query-status", nil)
+	if err != nil {
+		return status, err
+	}
+	err = json.Unmarshal(result, &status)
+	if err != nil {
+		return status, fmt.Errorf("Failed to parse QMP status: %s", err)
+	}
+	return status, nil
+}
+
+func (c *QmpClient) Close() error {
+	return c.conn.Close()
+}
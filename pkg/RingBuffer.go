@@ -0,0 +1,50 @@
+package pkg
+
+import (
+	"sync"
+)
+
+// RingBuffer keeps the last bytes written to it, e.g. the tail of an
+// instance's stderr. It is safe for concurrent use.
+type RingBuffer struct {
+	lock    sync.Mutex
+	buf     []byte
+	written int64
+}
+
+func NewRingBuffer(size int) *RingBuffer {
+	return &RingBuffer{buf: make([]byte, size)}
+}
+
+// Write never fails, older bytes are overwritten once the buffer is full
+func (b *RingBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	n := len(p)
+	size := len(b.buf)
+	if size == 0 {
+		return n, nil
+	}
+	if len(p) > size {
+		b.written += int64(len(p) - size)
+		p = p[len(p)-size:]
+	}
+	for len(p) > 0 {
+		copied := copy(b.buf[b.written%int64(size):], p)
+		b.written += int64(copied)
+		p = p[copied:]
+	}
+	return n, nil
+}
+
+// Bytes returns a copy of the buffered bytes, oldest first
+func (b *RingBuffer) Bytes() []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	size := int64(len(b.buf))
+	if b.written <= size {
+		return append([]byte{}, b.buf[:b.written]...)
+	}
+	start := b.written % size
+	return append(append([]byte{}, b.buf[start:]...), b.buf[:start]...)
+}
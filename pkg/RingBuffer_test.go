@@ -0,0 +1,28 @@
+package pkg
+
+import (
+	"testing"
+)
+
+func TestRingBufferKeepsTail(t *testing.T) {
+	buffer := NewRingBuffer(8)
+	buffer.Write([]byte("hello"))
+	if got := string(buffer.Bytes()); got != "hello" {
+		t.Errorf("expected %q, got %q", "hello", got)
+	}
+
+	// wraps around the end of the buffer
+	buffer.Write([]byte(" world"))
+	if got := string(buffer.Bytes()); got != "lo world" {
+		t.Errorf("expected %q, got %q", "lo world", got)
+	}
+
+	// a write larger than the buffer keeps its end
+	n, err := buffer.Write([]byte("0123456789"))
+	if n != 10 || err != nil {
+		t.Errorf("expected the whole write to succeed, got %d, %v", n, err)
+	}
+	if got := string(buffer.Bytes()); got != "23456789" {
+		t.Errorf("expected %q, got %q", "23456789", got)
+	}
+}
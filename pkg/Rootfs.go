@@ -0,0 +1,117 @@
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// CloneFile creates dst as a copy-on-write clone of src. On filesystems with
+// reflink support (btrfs, xfs) this is instant and shares all blocks with src,
+// elsewhere it falls back to copy_file_range which still avoids copying
+// through user space.
+func CloneFile(src string, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s: %s", src, err)
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create %s: %s", dst, err)
+	}
+	defer dstFile.Close()
+
+	err = unix.IoctlFileClone(int(dstFile.Fd()), int(srcFile.Fd()))
+	if err == nil {
+		return nil
+	}
+
+	_, err = io.Copy(dstFile, srcFile)
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("Failed to copy %s to %s: %s", src, dst, err)
+	}
+	return nil
+}
+
+// CreateScratchImage creates an empty ext4 image of size bytes at path. The
+// file is sparse, so only the filesystem's metadata takes up space.
+func CreateScratchImage(path string, size int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create %s: %s", path, err)
+	}
+	err = file.Truncate(size)
+	file.Close()
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("Failed to size %s: %s", path, err)
+	}
+
+	out, err := exec.Command("mkfs.ext4", "-q", "-F", path).CombinedOutput()
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("Failed to format %s: %s, %s", path, err, out)
+	}
+	return nil
+}
+
+// MountOverlay mounts an overlayfs at target with lower as its read-only
+// layer. Writes go to upper, which must be on the same filesystem as work.
+func MountOverlay(lower string, upper string, work string, target string) error {
+	lower, err := filepath.Abs(lower)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve overlay lower dir: %s", err)
+	}
+	for _, dir := range []string{upper, work, target} {
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create overlay dir: %s", err)
+		}
+	}
+
+	options := "lowerdir=" + lower + ",upperdir=" + upper + ",workdir=" + work
+	err = unix.Mount("overlay", target, "overlay", 0, options)
+	if err != nil {
+		return fmt.Errorf("Failed to mount overlay at %s: %s", target, err)
+	}
+	return nil
+}
+
+// UnmountOverlay unmounts an overlayfs mounted by MountOverlay
+func UnmountOverlay(target string) error {
+	err := unix.Unmount(target, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to unmount overlay at %s: %s", target, err)
+	}
+	return nil
+}
+
+// MountTmpfs mounts a tmpfs at target, creating it. An overlayfs can keep its
+// upper and work dirs on it wherever the hypervisor itself runs.
+func MountTmpfs(target string) error {
+	err := os.MkdirAll(target, 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create %s: %s", target, err)
+	}
+	err = unix.Mount("tmpfs", target, "tmpfs", 0, "mode=0755")
+	if err != nil {
+		return fmt.Errorf("Failed to mount tmpfs at %s: %s", target, err)
+	}
+	return nil
+}
+
+// Unmount unmounts a filesystem mounted by MountTmpfs
+func Unmount(target string) error {
+	err := unix.Unmount(target, 0)
+	if err != nil {
+		return fmt.Errorf("Failed to unmount %s: %s", target, err)
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"math"
 	"sort"
 	"sync"
+	"time"
 )
 
 type Stats struct {
@@ -11,22 +12,53 @@ type Stats struct {
 	vmInitTimeNanoLock   sync.Mutex
 	funcExecTimeNano     []int64
 	funcExecTimeNanoLock sync.Mutex
+	// Time to get a connection to an instance, close to zero when a kept-alive one is reused
+	connSetupTimeNano     []int64
+	connSetupTimeNanoLock sync.Mutex
+	// Time from sending a request over a connection to the end of the instance's response
+	instanceExecTimeNano     []int64
+	instanceExecTimeNanoLock sync.Mutex
 }
 
 type StatsSummary struct {
-	NumbInitVms         uint16
-	VmInitTimeNanoAvg   int64
-	VmInitTimeNanoStd   float64
-	VmInitTimeNano95    int64
-	VmInitTimeNanoMax   int64
-	FuncExecTimeNanoAvg int64
-	FuncExecTimeNanoStd float64
-	FuncExecTimeNano95  int64
-	FuncExecTimeNanoMax int64
+	NumbInitVms             uint16
+	VmInitTimeNanoAvg       int64
+	VmInitTimeNanoStd       float64
+	VmInitTimeNano95        int64
+	VmInitTimeNanoMax       int64
+	FuncExecTimeNanoAvg     int64
+	FuncExecTimeNanoStd     float64
+	FuncExecTimeNano95      int64
+	FuncExecTimeNanoMax     int64
+	ConnSetupTimeNanoAvg    int64
+	ConnSetupTimeNanoStd    float64
+	ConnSetupTimeNano95     int64
+	ConnSetupTimeNanoMax    int64
+	InstanceExecTimeNanoAvg int64
+	InstanceExecTimeNanoStd float64
+	InstanceExecTimeNano95  int64
+	InstanceExecTimeNanoMax int64
+}
+
+// StatsSamples holds every recorded sample in the order it was recorded
+type StatsSamples struct {
+	VmInitTimeNano       []int64
+	FuncExecTimeNano     []int64
+	ConnSetupTimeNano    []int64
+	InstanceExecTimeNano []int64
+}
+
+// CrashStats counts the instances of a function that exited without being
+// stopped and describes the latest of them
+type CrashStats struct {
+	Count          int64
+	LastExitCode   int
+	LastStderrTail string
+	LastCrashTime  time.Time
 }
 
 func NewStats() Stats {
-	return Stats{vmInitTimeNanoLock: sync.Mutex{}, funcExecTimeNanoLock: sync.Mutex{}}
+	return Stats{vmInitTimeNanoLock: sync.Mutex{}, funcExecTimeNanoLock: sync.Mutex{}, connSetupTimeNanoLock: sync.Mutex{}, instanceExecTimeNanoLock: sync.Mutex{}}
 }
 
 func (s *Stats) AddVmInitTimeNano(time int64) {
@@ -41,6 +73,18 @@ func (s *Stats) AddFuncExecTimeNano(time int64) {
 	s.funcExecTimeNanoLock.Unlock()
 }
 
+func (s *Stats) AddConnSetupTimeNano(time int64) {
+	s.connSetupTimeNanoLock.Lock()
+	s.connSetupTimeNano = append(s.connSetupTimeNano, time)
+	s.connSetupTimeNanoLock.Unlock()
+}
+
+func (s *Stats) AddInstanceExecTimeNano(time int64) {
+	s.instanceExecTimeNanoLock.Lock()
+	s.instanceExecTimeNano = append(s.instanceExecTimeNano, time)
+	s.instanceExecTimeNanoLock.Unlock()
+}
+
 func (s *Stats) GetStatsSummary() StatsSummary {
 	s.vmInitTimeNanoLock.Lock()
 	s.funcExecTimeNanoLock.Lock()
@@ -51,19 +95,51 @@ func (s *Stats) GetStatsSummary() StatsSummary {
 	s.vmInitTimeNanoLock.Unlock()
 	s.funcExecTimeNanoLock.Unlock()
 
+	s.connSetupTimeNanoLock.Lock()
+	_, connSetupTimeNanoAvg, connSetupTimeNanoStd, connSetupTimeNano95, connSetupTimeNanoMax := computeLenAvgStd95thMax(s.connSetupTimeNano)
+	s.connSetupTimeNanoLock.Unlock()
+	s.instanceExecTimeNanoLock.Lock()
+	_, instanceExecTimeNanoAvg, instanceExecTimeNanoStd, instanceExecTimeNano95, instanceExecTimeNanoMax := computeLenAvgStd95thMax(s.instanceExecTimeNano)
+	s.instanceExecTimeNanoLock.Unlock()
+
 	return StatsSummary{
-		NumbInitVms:         vmInitTimeNanoLen,
-		VmInitTimeNanoAvg:   vmInitTimeNanoAvg,
-		VmInitTimeNanoStd:   vmInitTimeNanoStd,
-		VmInitTimeNano95:    vmInitTimeNano95,
-		VmInitTimeNanoMax:   vmInitTimeNanoMax,
-		FuncExecTimeNanoAvg: funcExecTimeNanoAvg,
-		FuncExecTimeNanoStd: funcExecTimeNanoStd,
-		FuncExecTimeNano95:  funcExecTimeNano95,
-		FuncExecTimeNanoMax: funcExecTimeNanoMax,
+		NumbInitVms:             vmInitTimeNanoLen,
+		VmInitTimeNanoAvg:       vmInitTimeNanoAvg,
+		VmInitTimeNanoStd:       vmInitTimeNanoStd,
+		VmInitTimeNano95:        vmInitTimeNano95,
+		VmInitTimeNanoMax:       vmInitTimeNanoMax,
+		FuncExecTimeNanoAvg:     funcExecTimeNanoAvg,
+		FuncExecTimeNanoStd:     funcExecTimeNanoStd,
+		FuncExecTimeNano95:      funcExecTimeNano95,
+		FuncExecTimeNanoMax:     funcExecTimeNanoMax,
+		ConnSetupTimeNanoAvg:    connSetupTimeNanoAvg,
+		ConnSetupTimeNanoStd:    connSetupTimeNanoStd,
+		ConnSetupTimeNano95:     connSetupTimeNano95,
+		ConnSetupTimeNanoMax:    connSetupTimeNanoMax,
+		InstanceExecTimeNanoAvg: instanceExecTimeNanoAvg,
+		InstanceExecTimeNanoStd: instanceExecTimeNanoStd,
+		InstanceExecTimeNano95:  instanceExecTimeNano95,
+		InstanceExecTimeNanoMax: instanceExecTimeNanoMax,
 	}
 }
 
+func (s *Stats) GetSamples() StatsSamples {
+	s.vmInitTimeNanoLock.Lock()
+	vmInitTimeNano := append([]int64{}, s.vmInitTimeNano...)
+	s.vmInitTimeNanoLock.Unlock()
+	s.funcExecTimeNanoLock.Lock()
+	funcExecTimeNano := append([]int64{}, s.funcExecTimeNano...)
+	s.funcExecTimeNanoLock.Unlock()
+	s.connSetupTimeNanoLock.Lock()
+	connSetupTimeNano := append([]int64{}, s.connSetupTimeNano...)
+	s.connSetupTimeNanoLock.Unlock()
+	s.instanceExecTimeNanoLock.Lock()
+	instanceExecTimeNano := append([]int64{}, s.instanceExecTimeNano...)
+	s.instanceExecTimeNanoLock.Unlock()
+
+	return StatsSamples{VmInitTimeNano: vmInitTimeNano, FuncExecTimeNano: funcExecTimeNano, ConnSetupTimeNano: connSetupTimeNano, InstanceExecTimeNano: instanceExecTimeNano}
+}
+
 func computeLenAvgStd95thMax(data []int64) (uint16, int64, float64, int64, int64) {
 	var N uint16 = 0
 	var sum int64 = 0
@@ -81,10 +157,12 @@ func computeLenAvgStd95thMax(data []int64) (uint16, int64, float64, int64, int64
 	}
 	std = math.Sqrt(std / float64(N))
 
-	sort.Slice(data, func(i, j int) bool {
-		return data[i] < data[j]
+	// sort a copy so the samples stay in the order they were recorded
+	sorted := append([]int64(nil), data...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
 	})
-	percentile95 := data[int(float64(N)*0.95)]
+	percentile95 := sorted[int(float64(N)*0.95)]
 
-	return N, avg, std, percentile95, data[N-1]
+	return N, avg, std, percentile95, sorted[N-1]
 }
@@ -16,18 +16,15 @@ type node struct {
 }
 
 func NewPool(new func() any) *VmPool {
-	dummyNode := atomic.Pointer[node]{}
-
-	dummyNode.Store(&node{
+	dummyNode := &node{
 		next: atomic.Pointer[node]{},
-		item: atomic.Pointer[any]{},
-	})
-
-	return &VmPool{
-		new:  new,
-		head: dummyNode,
-		tail: dummyNode,
+		item: nil,
 	}
+
+	pool := &VmPool{new: new}
+	pool.head.Store(dummyNode)
+	pool.tail.Store(dummyNode)
+	return pool
 }
 
 func (p *VmPool) Put(item any) {
@@ -46,18 +43,23 @@ func (p *VmPool) Put(item any) {
 }
 
 func (p *VmPool) Get() any {
+	item := p.TryGet()
+	if item == nil && p.new != nil {
+		return p.new()
+	}
+	return item
+}
+
+// TryGet removes the oldest item from the pool, returning nil rather than
+// creating a new item when the pool is empty
+func (p *VmPool) TryGet() any {
 	var item any
 	for true {
 		localHead := p.head.Load()
 		localHeadNext := localHead.next.Load()
 
 		if localHeadNext == nil {
-			if p.new != nil {
-				newItem := p.new()
-				return newItem
-			} else {
-				return nil
-			}
+			return nil
 		}
 
 		item = localHeadNext.item
@@ -0,0 +1,106 @@
+package pkg
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestVmPoolFifo(t *testing.T) {
+	pool := NewPool(nil)
+	for i := 0; i < 3; i++ {
+		pool.Put(i)
+	}
+	for i := 0; i < 3; i++ {
+		if item := pool.Get(); item != i {
+			t.Errorf("expected %d, got %v", i, item)
+		}
+	}
+	if item := pool.Get(); item != nil {
+		t.Errorf("expected an empty pool to return nil, got %v", item)
+	}
+}
+
+func TestVmPoolNew(t *testing.T) {
+	var created atomic.Int64
+	pool := NewPool(func() any {
+		return int(created.Add(1))
+	})
+
+	if item := pool.Get(); item != 1 {
+		t.Errorf("expected a new item from an empty pool, got %v", item)
+	}
+	pool.Put(100)
+	if item := pool.Get(); item != 100 {
+		t.Errorf("expected the pooled item, got %v", item)
+	}
+	if created.Load() != 1 {
+		t.Errorf("expected 1 item to be created, got %d", created.Load())
+	}
+}
+
+func TestVmPoolConcurrent(t *testing.T) {
+	const producers, itemsPerProducer = 8, 1000
+	pool := NewPool(nil)
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := 0; i < itemsPerProducer; i++ {
+				pool.Put(p*itemsPerProducer + i)
+			}
+		}(p)
+	}
+
+	// consume while producers are still adding items
+	var seenLock sync.Mutex
+	seen := make(map[int]int)
+	var consumed atomic.Int64
+	var consumers sync.WaitGroup
+	for c := 0; c < producers; c++ {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			for consumed.Load() < producers*itemsPerProducer {
+				item := pool.Get()
+				if item == nil {
+					continue
+				}
+				consumed.Add(1)
+				seenLock.Lock()
+				seen[item.(int)]++
+				seenLock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	consumers.Wait()
+
+	if len(seen) != producers*itemsPerProducer {
+		t.Errorf("expected %d distinct items, got %d", producers*itemsPerProducer, len(seen))
+	}
+	for item, count := range seen {
+		if count != 1 {
+			t.Errorf("item %d was returned %d times", item, count)
+		}
+	}
+	if item := pool.Get(); item != nil {
+		t.Errorf("expected the pool to be empty, got %v", item)
+	}
+}
+
+func TestVmPoolTryGet(t *testing.T) {
+	pool := NewPool(func() any {
+		t.Error("TryGet must not create items")
+		return 0
+	})
+	if item := pool.TryGet(); item != nil {
+		t.Errorf("expected nil from an empty pool, got %v", item)
+	}
+	pool.Put(1)
+	if item := pool.TryGet(); item != 1 {
+		t.Errorf("expected the pooled item, got %v", item)
+	}
+}
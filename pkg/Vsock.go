@@ -0,0 +1,154 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// VsockAddr is the address of one end of a vsock connection. It prints the
+// guest as a host name, so a vsock peer looks like any other HTTP client.
+type VsockAddr struct {
+	Cid  uint32
+	Port uint32
+}
+
+func (a VsockAddr) Network() string {
+	return "vsock"
+}
+
+func (a VsockAddr) String() string {
+	return net.JoinHostPort(VsockHost(a.Cid), strconv.FormatUint(uint64(a.Port), 10))
+}
+
+// VsockHost names the guest with context ID cid where a host name is expected
+func VsockHost(cid uint32) string {
+	return fmt.Sprintf("vsock-%d", cid)
+}
+
+type vsockConn struct {
+	*os.File
+	local  VsockAddr
+	remote VsockAddr
+}
+
+func (c *vsockConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *vsockConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// DialVsock connects to port of the guest with context ID cid, e.g. a QEMU
+// guest with a vhost-vsock device
+func DialVsock(ctx context.Context, cid uint32, port uint32) (net.Conn, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create vsock socket: %s", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout := unix.NsecToTimeval(int64(time.Until(deadline)))
+		unix.SetsockoptTimeval(fd, unix.AF_VSOCK, unix.SO_VM_SOCKETS_CONNECT_TIMEOUT, &timeout)
+	}
+	err = unix.Connect(fd, &unix.SockaddrVM{CID: cid, Port: port})
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Failed to connect to vsock %d:%d: %s", cid, port, err)
+	}
+	return newVsockConn(fd, VsockAddr{Cid: cid, Port: port})
+}
+
+func newVsockConn(fd int, remote VsockAddr) (net.Conn, error) {
+	var local VsockAddr
+	if sa, err := unix.Getsockname(fd); err == nil {
+		if vm, ok := sa.(*unix.SockaddrVM); ok {
+			local = VsockAddr{Cid: vm.CID, Port: vm.Port}
+		}
+	}
+	// a non-blocking file is driven by the runtime poller, which makes
+	// deadlines work and lets Close interrupt pending reads
+	err := unix.SetNonblock(fd, true)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Failed to configure vsock socket: %s", err)
+	}
+	return &vsockConn{File: os.NewFile(uintptr(fd), "vsock:"+remote.String()), local: local, remote: remote}, nil
+}
+
+type vsockListener struct {
+	file   *os.File
+	addr   VsockAddr
+	closed atomic.Bool
+}
+
+// ListenVsock accepts connections from any guest to port on the host
+func ListenVsock(port uint32) (net.Listener, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create vsock socket: %s", err)
+	}
+	err = unix.Bind(fd, &unix.SockaddrVM{CID: unix.VMADDR_CID_ANY, Port: port})
+	if err == nil {
+		err = unix.Listen(fd, unix.SOMAXCONN)
+	}
+	if err == nil {
+		err = unix.SetNonblock(fd, true)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Failed to listen on vsock port %d: %s", port, err)
+	}
+	// the kernel picks the port when asked for VMADDR_PORT_ANY
+	addr := VsockAddr{Cid: unix.VMADDR_CID_ANY, Port: port}
+	if sa, err := unix.Getsockname(fd); err == nil {
+		if vm, ok := sa.(*unix.SockaddrVM); ok {
+			addr.Port = vm.Port
+		}
+	}
+	return &vsockListener{file: os.NewFile(uintptr(fd), "vsock:"+addr.String()), addr: addr}, nil
+}
+
+func (l *vsockListener) Accept() (net.Conn, error) {
+	raw, err := l.file.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var fd int
+	var sa unix.Sockaddr
+	var acceptErr error
+	err = raw.Read(func(listenFd uintptr) bool {
+		fd, sa, acceptErr = unix.Accept4(int(listenFd), unix.SOCK_CLOEXEC)
+		// returning false waits until the listener is readable again
+		return acceptErr != unix.EAGAIN
+	})
+	if l.closed.Load() {
+		// callers such as http.Server expect the error of a closed network listener
+		return nil, net.ErrClosed
+	} else if err != nil {
+		return nil, err
+	}
+	if acceptErr != nil {
+		return nil, fmt.Errorf("Failed to accept vsock connection: %s", acceptErr)
+	}
+	var remote VsockAddr
+	if vm, ok := sa.(*unix.SockaddrVM); ok {
+		remote = VsockAddr{Cid: vm.CID, Port: vm.Port}
+	}
+	return newVsockConn(fd, remote)
+}
+
+func (l *vsockListener) Close() error {
+	l.closed.Store(true)
+	return l.file.Close()
+}
+
+func (l *vsockListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,68 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestVsockLoopback(t *testing.T) {
+	listener, err := ListenVsock(unix.VMADDR_PORT_ANY)
+	if err != nil {
+		t.Skipf("vsock is unavailable: %s", err)
+	}
+	defer listener.Close()
+	port := listener.Addr().(VsockAddr).Port
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := DialVsock(ctx, unix.VMADDR_CID_LOCAL, port)
+	if err != nil {
+		t.Skipf("vsock loopback is unavailable: %s", err)
+	}
+	defer conn.Close()
+
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+	if cid := accepted.RemoteAddr().(VsockAddr).Cid; cid != unix.VMADDR_CID_LOCAL {
+		t.Errorf("expected the peer's context ID %d, got %d", unix.VMADDR_CID_LOCAL, cid)
+	}
+
+	go conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	accepted.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("expected ping, got %q: %v", buf, err)
+	}
+}
+
+func TestVsockListenerClose(t *testing.T) {
+	listener, err := ListenVsock(unix.VMADDR_PORT_ANY)
+	if err != nil {
+		t.Skipf("vsock is unavailable: %s", err)
+	}
+	accepted := make(chan error)
+	go func() {
+		_, err := listener.Accept()
+		accepted <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	listener.Close()
+
+	select {
+	case err := <-accepted:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("expected %v once the listener is closed, got %v", net.ErrClosed, err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Accept did not return after the listener was closed")
+	}
+}